@@ -2,10 +2,14 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -19,6 +23,26 @@ type SSHAuthConfig struct {
 	Timeout    time.Duration
 }
 
+// KeyRolloutConfig описывает изменения authorized_keys при ротации ключей
+type KeyRolloutConfig struct {
+	AddKey            string // Строка публичного ключа в формате authorized_keys
+	RemoveFingerprint string // SHA256-отпечаток удаляемого ключа
+	VerifyKey         string // Приватный ключ для повторной проверки после изменений
+	DryRun            bool
+
+	addFingerprint string
+	removesOwnKey  bool // удаляется ключ из -key, которым выполняется подключение
+}
+
+// KeyRolloutResult представляет результат изменения authorized_keys на сервере
+type KeyRolloutResult struct {
+	Server  string
+	Changes []string
+	Changed bool
+	Backup  string
+	Error   string
+}
+
 // SSHCheckResult представляет результат проверки SSH
 type SSHCheckResult struct {
 	Server   string
@@ -65,10 +89,8 @@ func parsePrivateKey(keyPath string, passphrase []byte) (ssh.Signer, error) {
 	return ssh.ParsePrivateKey(keyData)
 }
 
-// checkSSHAuth проверяет аутентификацию по SSH на сервере
-func checkSSHAuth(server string, config *SSHAuthConfig) SSHCheckResult {
-	startTime := time.Now()
-
+// dialSSH устанавливает SSH-соединение с сервером по ключу из конфигурации
+func dialSSH(server string, config *SSHAuthConfig) (*ssh.Client, error) {
 	// Чтение и парсинг приватного ключа
 	var passphrase []byte
 	if config.Passphrase != "" {
@@ -77,11 +99,7 @@ func checkSSHAuth(server string, config *SSHAuthConfig) SSHCheckResult {
 
 	signer, err := parsePrivateKey(config.PrivateKey, passphrase)
 	if err != nil {
-		return SSHCheckResult{
-			Server:  server,
-			Success: false,
-			Error:   fmt.Sprintf("Ошибка парсинга ключа: %v", err),
-		}
+		return nil, fmt.Errorf("Ошибка парсинга ключа: %v", err)
 	}
 
 	// Конфигурация SSH клиента
@@ -97,11 +115,23 @@ func checkSSHAuth(server string, config *SSHAuthConfig) SSHCheckResult {
 	// Попытка подключения
 	address := net.JoinHostPort(server, "22")
 	client, err := ssh.Dial("tcp", address, sshConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Ошибка подключения: %v", err)
+	}
+
+	return client, nil
+}
+
+// checkSSHAuth проверяет аутентификацию по SSH на сервере
+func checkSSHAuth(server string, config *SSHAuthConfig) SSHCheckResult {
+	startTime := time.Now()
+
+	client, err := dialSSH(server, config)
 	if err != nil {
 		return SSHCheckResult{
 			Server:  server,
 			Success: false,
-			Error:   fmt.Sprintf("Ошибка подключения: %v", err),
+			Error:   err.Error(),
 		}
 	}
 	defer client.Close()
@@ -126,20 +156,293 @@ func checkSSHAuth(server string, config *SSHAuthConfig) SSHCheckResult {
 	}
 }
 
-func main() {
-	// Конфигурация (можно вынести в аргументы командной строки или конфиг файл)
-	config := &SSHAuthConfig{
-		Username:   "your-username",        // Замените на ваше имя пользователя
-		PrivateKey: "/path/to/private/key", // Замените на путь к вашему приватному ключу
-		Timeout:    10 * time.Second,
+// runRemote выполняет команду на сервере и возвращает её stdout
+func runRemote(client *ssh.Client, cmd string, stdin io.Reader) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("Ошибка создания сессии: %v", err)
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdin = stdin
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+
+	if err := session.Run(cmd); err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.String(), nil
+}
+
+// normalizeFingerprint приводит отпечаток к виду SHA256:..., как его печатает ssh-keygen -l
+func normalizeFingerprint(fp string) string {
+	fp = strings.TrimSpace(fp)
+	if fp != "" && !strings.HasPrefix(fp, "SHA256:") {
+		fp = "SHA256:" + fp
+	}
+	return fp
+}
+
+// describeKeyLine возвращает краткое описание строки authorized_keys: тип, отпечаток и комментарий
+func describeKeyLine(line string) string {
+	pub, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return line
 	}
+	return strings.TrimSpace(fmt.Sprintf("%s %s %s", pub.Type(), ssh.FingerprintSHA256(pub), comment))
+}
+
+// updateAuthorizedKeys применяет изменения к содержимому authorized_keys.
+// Возвращает новое содержимое и список изменений ("+ ..." / "- ..."); пустой список
+// означает, что файл уже в нужном состоянии.
+func updateAuthorizedKeys(content string, rollout *KeyRolloutConfig) (string, []string) {
+	var lines, changes []string
+	if trimmed := strings.TrimRight(content, "\n"); trimmed != "" {
+		lines = strings.Split(trimmed, "\n")
+	}
+
+	var result []string
+	hasNewKey := false
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			result = append(result, line)
+			continue
+		}
+
+		// Строки, которые не удалось разобрать, оставляем как есть
+		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(trimmed))
+		if err != nil {
+			result = append(result, line)
+			continue
+		}
+
+		fingerprint := ssh.FingerprintSHA256(pub)
+		if rollout.RemoveFingerprint != "" && fingerprint == rollout.RemoveFingerprint {
+			changes = append(changes, "- "+describeKeyLine(trimmed))
+			continue
+		}
+		if rollout.AddKey != "" && fingerprint == rollout.addFingerprint {
+			hasNewKey = true
+		}
+		result = append(result, line)
+	}
+
+	if rollout.AddKey != "" && !hasNewKey {
+		result = append(result, rollout.AddKey)
+		changes = append(changes, "+ "+describeKeyLine(rollout.AddKey))
+	}
+
+	return strings.Join(result, "\n") + "\n", changes
+}
+
+// rolloutKey добавляет и/или удаляет ключ в ~/.ssh/authorized_keys на сервере.
+// Перед записью исходный файл сохраняется в резервную копию (если backup), запись
+// выполняется через временный файл и mv, чтобы не оставить обрезанный authorized_keys.
+func rolloutKey(server string, config *SSHAuthConfig, rollout *KeyRolloutConfig, backup bool) KeyRolloutResult {
+	result := KeyRolloutResult{Server: server}
+
+	client, err := dialSSH(server, config)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer client.Close()
+
+	// Чтение текущего authorized_keys (отсутствующий файл считаем пустым)
+	current, err := runRemote(client, `f="$HOME/.ssh/authorized_keys"; if [ -f "$f" ]; then cat "$f"; fi`, nil)
+	if err != nil {
+		result.Error = fmt.Sprintf("Ошибка чтения authorized_keys: %v", err)
+		return result
+	}
+
+	updated, changes := updateAuthorizedKeys(current, rollout)
+	result.Changes = changes
+	if len(changes) == 0 || rollout.DryRun {
+		return result
+	}
+
+	script := `set -e
+umask 077
+mkdir -p "$HOME/.ssh"
+f="$HOME/.ssh/authorized_keys"
+`
+	if backup {
+		backupSuffix := ".bak." + time.Now().Format("20060102-150405")
+		script += `if [ -f "$f" ]; then cp -p "$f" "$f` + backupSuffix + `"; echo "$f` + backupSuffix + `"; fi
+`
+	}
+	script += `cat > "$f.tmp.$$"
+chmod 600 "$f.tmp.$$"
+mv -f "$f.tmp.$$" "$f"`
+
+	backupPath, err := runRemote(client, script, strings.NewReader(updated))
+	if err != nil {
+		result.Error = fmt.Sprintf("Ошибка записи authorized_keys: %v", err)
+		return result
+	}
+
+	result.Changed = true
+	result.Backup = strings.TrimSpace(backupPath)
+	return result
+}
+
+// rolloutOwnKey удаляет ключ, которым выполняется подключение, только после
+// того, как на сервере подтверждён доступ ключом -verify-key: сначала
+// добавляется новый ключ, затем проверяется вход, и лишь потом удаляется старый
+func rolloutOwnKey(server string, config, verifyConfig *SSHAuthConfig, rollout *KeyRolloutConfig) KeyRolloutResult {
+	add := *rollout
+	add.RemoveFingerprint = ""
+	result := rolloutKey(server, config, &add, true)
+	if result.Error != "" {
+		return result
+	}
+
+	check := checkSSHAuth(server, verifyConfig)
+	if !check.Success {
+		result.Error = fmt.Sprintf("Ключ -verify-key не работает (%s), ключ -key не удалён", check.Error)
+		return result
+	}
+
+	// Резервная копия исходного файла уже снята при добавлении ключа; вторая
+	// копия в ту же секунду перезаписала бы её промежуточным состоянием
+	remove := *rollout
+	remove.AddKey = ""
+	second := rolloutKey(server, config, &remove, !result.Changed)
+	result.Changes = append(result.Changes, second.Changes...)
+	result.Changed = result.Changed || second.Changed
+	if result.Backup == "" {
+		result.Backup = second.Backup
+	}
+	result.Error = second.Error
+	return result
+}
+
+// readPublicKey читает публичный ключ и возвращает его строку и отпечаток
+func readPublicKey(keyPath string) (string, string, error) {
+	keyData, err := os.ReadFile(keyPath)
+	if err != nil {
+		return "", "", fmt.Errorf("не удалось прочитать файл ключа: %v", err)
+	}
+
+	line := strings.TrimSpace(string(keyData))
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return "", "", fmt.Errorf("не удалось разобрать публичный ключ: %v", err)
+	}
+
+	return line, ssh.FingerprintSHA256(pub), nil
+}
+
+// runKeyRollout выполняет ротацию ключей на всех серверах и печатает результат
+func runKeyRollout(servers []string, config *SSHAuthConfig, rollout *KeyRolloutConfig) {
+	if rollout.DryRun {
+		fmt.Printf("Пробный запуск: изменения authorized_keys на %d серверах не применяются\n", len(servers))
+	} else {
+		fmt.Printf("Изменение authorized_keys на %d серверах...\n", len(servers))
+	}
+	fmt.Println("==============================================")
+
+	verifyConfig := &SSHAuthConfig{
+		Username:   config.Username,
+		PrivateKey: rollout.VerifyKey,
+		Timeout:    config.Timeout,
+	}
+
+	for _, server := range servers {
+		var result KeyRolloutResult
+		if rollout.removesOwnKey && !rollout.DryRun {
+			result = rolloutOwnKey(server, config, verifyConfig, rollout)
+		} else {
+			result = rolloutKey(server, config, rollout, true)
+		}
+
+		switch {
+		case result.Error != "":
+			fmt.Printf("❌ %s: Ошибка - %s\n", result.Server, result.Error)
+			continue
+		case len(result.Changes) == 0:
+			fmt.Printf("✅ %s: Изменения не требуются\n", result.Server)
+		case rollout.DryRun:
+			fmt.Printf("📝 %s: Будет изменено:\n", result.Server)
+		default:
+			fmt.Printf("🔑 %s: authorized_keys изменён:\n", result.Server)
+		}
+		for _, change := range result.Changes {
+			fmt.Printf("    %s\n", change)
+		}
+		if result.Backup != "" {
+			fmt.Printf("    Резервная копия: %s\n", result.Backup)
+		}
+
+		// Повторная проверка доступа новым ключом
+		if rollout.DryRun || rollout.VerifyKey == "" {
+			continue
+		}
+		check := checkSSHAuth(server, verifyConfig)
+		if check.Success {
+			fmt.Printf("✅ %s: Новый ключ работает (время: %v)\n", check.Server, check.Duration)
+		} else {
+			fmt.Printf("❌ %s: Новый ключ не работает - %s\n", check.Server, check.Error)
+		}
+	}
+}
+
+func main() {
+	// Конфигурация (по умолчанию - прежние значения-заглушки)
+	config := &SSHAuthConfig{Timeout: 10 * time.Second}
+	serverList := flag.String("servers", "servers.txt", "Файл со списком серверов")
+	flag.StringVar(&config.Username, "user", "your-username", "Имя пользователя SSH")
+	flag.StringVar(&config.PrivateKey, "key", "/path/to/private/key", "Приватный ключ для подключения")
+	flag.DurationVar(&config.Timeout, "timeout", config.Timeout, "Таймаут подключения")
+
+	// Параметры ротации ключей
+	rollout := &KeyRolloutConfig{}
+	addKeyPath := flag.String("add-key", "", "Публичный ключ (.pub), который нужно добавить в authorized_keys")
+	flag.StringVar(&rollout.RemoveFingerprint, "remove-fingerprint", "", "SHA256-отпечаток ключа, который нужно удалить из authorized_keys")
+	flag.StringVar(&rollout.VerifyKey, "verify-key", "", "Приватный ключ для проверки доступа после изменений")
+	flag.BoolVar(&rollout.DryRun, "dry-run", false, "Показать изменения без записи на серверы")
+	flag.Parse()
 
 	// Чтение списка серверов
-	servers, err := readServerList("servers.txt") // Замените на ваш файл со списком серверов
+	servers, err := readServerList(*serverList)
 	if err != nil {
 		log.Fatalf("Ошибка чтения файла со списком серверов: %v", err)
 	}
 
+	if *addKeyPath != "" || rollout.RemoveFingerprint != "" {
+		if *addKeyPath != "" {
+			rollout.AddKey, rollout.addFingerprint, err = readPublicKey(*addKeyPath)
+			if err != nil {
+				log.Fatalf("Ошибка чтения добавляемого ключа: %v", err)
+			}
+		}
+		rollout.RemoveFingerprint = normalizeFingerprint(rollout.RemoveFingerprint)
+		if rollout.RemoveFingerprint != "" && rollout.RemoveFingerprint == rollout.addFingerprint {
+			log.Fatal("Добавляемый и удаляемый ключ совпадают")
+		}
+
+		// Удаление собственного ключа отрезало бы доступ ко всем серверам
+		signer, err := parsePrivateKey(config.PrivateKey, []byte(config.Passphrase))
+		if err != nil {
+			log.Fatalf("Ошибка чтения ключа -key: %v", err)
+		}
+		if rollout.RemoveFingerprint != "" && rollout.RemoveFingerprint == ssh.FingerprintSHA256(signer.PublicKey()) {
+			if rollout.VerifyKey == "" {
+				log.Fatal("Удаляемый ключ совпадает с ключом -key: укажите -verify-key, доступ которым будет проверен перед удалением")
+			}
+			rollout.removesOwnKey = true
+		}
+		if rollout.AddKey != "" && rollout.VerifyKey == "" {
+			log.Printf("Внимание: -verify-key не задан, доступ после добавления ключа проверяться не будет")
+		}
+
+		runKeyRollout(servers, config, rollout)
+		return
+	}
+
 	fmt.Printf("Проверка SSH доступности для %d серверов...\n", len(servers))
 	fmt.Println("==============================================")
 
@@ -2,26 +2,165 @@ package main
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
+// Статусы обработки приложения
+const (
+	statusDownloaded = "downloaded"
+	statusSkipped    = "skipped"
+	statusMissing    = "missing"
+	statusFailed     = "failed"
+)
+
+// patternChars - символы, допустимые в шаблонах файлов
+const patternChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789._-/*?[]!"
+
+// errRemoteNotFound возвращается, если файла нет на удалённом сервере
+var errRemoteNotFound = errors.New("remote file not found")
+
+// collectConfig описывает, какие файлы и откуда собирать
+type collectConfig struct {
+	BaseDir      string   // Каталог с приложениями на сервере
+	AppPattern   string   // Шаблон имён каталогов приложений
+	FilePatterns []string // Шаблоны путей файлов относительно каталога приложения
+	LocalBaseDir string   // Локальный каталог для скачанных файлов
+}
+
+// fileResult хранит результат обработки одного файла приложения.
+// Для статуса statusMissing в Path лежит шаблон, которому ничего не соответствует.
+type fileResult struct {
+	App    string
+	Path   string
+	Status string
+	Err    error
+}
+
+// serverResult хранит результат обработки одного сервера
+type serverResult struct {
+	Server      string
+	Unreachable bool
+	Err         error
+	Files       []fileResult
+}
+
+// downloadState хранит успешно скачанные файлы (сервер/приложение/путь),
+// чтобы запуск с -resume после сбоя не скачивал их заново
+type downloadState struct {
+	mu      sync.Mutex
+	path    string
+	Started time.Time            `json:"started"` // начало прерванного запуска
+	Done    map[string]time.Time `json:"done"`
+}
+
+// datasource описывает JDBC-ресурс (элемент Resource) из context.xml
+type datasource struct {
+	Server          string `json:"-"`
+	App             string `json:"-"`
+	File            string `json:"file"`
+	Name            string `json:"name"`
+	Type            string `json:"type"`
+	DriverClassName string `json:"driverClassName"`
+	URL             string `json:"url"`
+	Username        string `json:"username"`
+	Password        string `json:"password"`
+	MaxTotal        string `json:"maxTotal"`
+	MaxIdle         string `json:"maxIdle"`
+	ValidationQuery string `json:"validationQuery"`
+}
+
 func main() {
+	// Режим работы
+	mode := flag.String("mode", "download", "Mode: download (collect files from servers), inventory (JDBC datasources from downloaded context.xml), drift (compare downloaded XML configs across servers), runs (list snapshots) or changes (compare two snapshots)")
+	format := flag.String("format", "csv", "Inventory output format: csv or json")
+	outputFile := flag.String("o", "", "Inventory output file (default stdout)")
+	snapshotDir := flag.String("snapshots", "./snapshots", "Directory for snapshots of downloaded files taken after each run (empty disables)")
+	fromRun := flag.String("from", "", "Snapshot to compare from in changes mode (default: second latest)")
+	toRun := flag.String("to", "", "Snapshot to compare to in changes mode (default: latest)")
+
 	// Параметры подключения
-	username := "your_username"
-	privateKeyPath := "/path/to/private/key"
-	serverListFile := "servers.txt"
-	localBaseDir := "./downloads"
+	username := flag.String("user", "your_username", "SSH username")
+	privateKeyPath := flag.String("key", "/path/to/private/key", "Path to SSH private key")
+	serverListFile := flag.String("servers", "servers.txt", "File with server list")
+	localBaseDir := flag.String("out", "./downloads", "Local directory for downloaded files")
+	baseDir := flag.String("base-dir", "/opt/solar", "Remote directory containing application directories")
+	appPattern := flag.String("apps", "*", "Glob for application directory names under -base-dir")
+	filePatterns := flag.String("files", "config/context.xml", "Comma-separated globs of files to collect, relative to the application directory")
+	workers := flag.Int("workers", 8, "Number of servers processed concurrently")
+	stateFile := flag.String("state", "", "State file with already downloaded files (default <out>/.state.json)")
+	resume := flag.Bool("resume", false, "Continue the previous incomplete run: skip files it already downloaded")
+	flag.Parse()
+
+	switch *mode {
+	case "download":
+	case "inventory":
+		if err := runInventory(*localBaseDir, *format, *outputFile); err != nil {
+			log.Fatalf("Inventory failed: %v", err)
+		}
+		return
+	case "drift":
+		if err := runDrift(*localBaseDir); err != nil {
+			log.Fatalf("Drift check failed: %v", err)
+		}
+		return
+	case "runs":
+		if err := listSnapshots(*snapshotDir); err != nil {
+			log.Fatalf("Failed to list snapshots: %v", err)
+		}
+		return
+	case "changes":
+		if err := runChanges(*snapshotDir, *fromRun, *toRun); err != nil {
+			log.Fatalf("Changes report failed: %v", err)
+		}
+		return
+	default:
+		log.Fatalf("Unknown mode %q", *mode)
+	}
+
+	if *stateFile == "" {
+		*stateFile = filepath.Join(*localBaseDir, ".state.json")
+	}
+	if *workers < 1 {
+		*workers = 1
+	}
+
+	collect := &collectConfig{
+		BaseDir:      *baseDir,
+		AppPattern:   *appPattern,
+		LocalBaseDir: *localBaseDir,
+	}
+	for _, pattern := range strings.Split(*filePatterns, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			collect.FilePatterns = append(collect.FilePatterns, pattern)
+		}
+	}
+	if err := collect.validate(); err != nil {
+		log.Fatalf("Invalid collection settings: %v", err)
+	}
 
 	// Чтение приватного ключа
-	privateKeyBytes, err := os.ReadFile(privateKeyPath)
+	privateKeyBytes, err := os.ReadFile(*privateKeyPath)
 	if err != nil {
 		log.Fatalf("Failed to read private key: %v", err)
 	}
@@ -34,7 +173,7 @@ func main() {
 
 	// Конфигурация SSH
 	sshConfig := &ssh.ClientConfig{
-		User: username,
+		User: *username,
 		Auth: []ssh.AuthMethod{
 			ssh.PublicKeys(signer),
 		},
@@ -43,114 +182,1374 @@ func main() {
 	}
 
 	// Чтение списка серверов
-	servers, err := readLines(serverListFile)
+	servers, err := readLines(*serverListFile)
 	if err != nil {
 		log.Fatalf("Failed to read server list: %v", err)
 	}
 
-	// Обработка каждого сервера
-	for _, server := range servers {
-		server = strings.TrimSpace(server)
-		if server == "" {
-			continue
+	// Состояние предыдущего запуска используется только с -resume, иначе
+	// каждый запуск скачивает всё заново
+	if !*resume {
+		if err := os.Remove(*stateFile); err != nil && !os.IsNotExist(err) {
+			log.Fatalf("Failed to reset state: %v", err)
+		}
+	}
+	state, err := loadState(*stateFile)
+	if err != nil {
+		log.Fatalf("Failed to load state: %v", err)
+	}
+	if len(state.Done) > 0 {
+		log.Printf("Resuming run started %s: %d files already downloaded",
+			state.Started.Format(time.RFC3339), len(state.Done))
+	}
+
+	// Обработка серверов пулом воркеров
+	results := make([]serverResult, len(servers))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < *workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				log.Printf("Connecting to %s...", servers[i])
+				results[i] = processServer(servers[i], sshConfig, collect, state)
+				if results[i].Err != nil {
+					log.Printf("Error processing %s: %v", servers[i], results[i].Err)
+				}
+			}
+		}()
+	}
+	for i := range servers {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	if printSummary(results) {
+		// Запуск прошёл полностью - следующий начнётся с чистого листа
+		if err := state.remove(); err != nil {
+			log.Printf("Failed to remove state file: %v", err)
 		}
+	} else {
+		log.Printf("Some servers or apps failed, re-run with -resume to retry only them (state: %s)", *stateFile)
+	}
 
-		log.Printf("Connecting to %s...", server)
-		err := processServer(server, sshConfig, localBaseDir)
+	if *snapshotDir != "" {
+		snapshot, err := takeSnapshot(*localBaseDir, *snapshotDir, results)
 		if err != nil {
-			log.Printf("Error processing %s: %v", server, err)
+			log.Fatalf("Failed to take snapshot: %v", err)
 		}
+		log.Printf("Snapshot %s saved: %d files, %d new objects", snapshot.ID, len(snapshot.Files), snapshot.newObjects)
 	}
 }
 
-func processServer(server string, config *ssh.ClientConfig, localBaseDir string) error {
+func processServer(server string, config *ssh.ClientConfig, collect *collectConfig, state *downloadState) serverResult {
+	result := serverResult{Server: server}
+
 	// Подключение по SSH
 	conn, err := ssh.Dial("tcp", server+":22", config)
 	if err != nil {
-		return fmt.Errorf("SSH connection failed: %w", err)
+		result.Unreachable = true
+		result.Err = fmt.Errorf("SSH connection failed: %w", err)
+		return result
 	}
 	defer conn.Close()
 
+	// SFTP-клиент; если подсистема недоступна, файлы скачиваются через cat
+	sftpClient, err := sftp.NewClient(conn)
+	if err != nil {
+		log.Printf("SFTP unavailable on %s, falling back to cat: %v", server, err)
+		sftpClient = nil
+	} else {
+		defer sftpClient.Close()
+	}
+
 	// Получение списка приложений
-	apps, err := listApplications(conn)
+	apps, err := listApplications(conn, sftpClient, collect.BaseDir, collect.AppPattern)
 	if err != nil {
-		return fmt.Errorf("failed to list applications: %w", err)
+		result.Err = fmt.Errorf("failed to list applications: %w", err)
+		return result
 	}
 
 	// Обработка каждого приложения
 	for _, app := range apps {
-		remotePath := fmt.Sprintf("/opt/solar/%s/config/context.xml", app)
-		localDir := filepath.Join(localBaseDir, server, app)
-		localPath := filepath.Join(localDir, "context.xml")
+		appDir := path.Join(collect.BaseDir, app)
+
+		for _, pattern := range collect.FilePatterns {
+			files, err := listAppFiles(conn, sftpClient, appDir, pattern)
+			if err != nil {
+				log.Printf("  [%s/%s] Error listing %s: %v", server, app, pattern, err)
+				result.Files = append(result.Files, fileResult{App: app, Path: pattern, Status: statusFailed, Err: err})
+				continue
+			}
+			if len(files) == 0 {
+				log.Printf("  [%s/%s] %s not found", server, app, pattern)
+				result.Files = append(result.Files, fileResult{App: app, Path: pattern, Status: statusMissing})
+				continue
+			}
+
+			for _, rel := range files {
+				result.Files = append(result.Files, collectFile(conn, sftpClient, server, app, rel, collect, state))
+			}
+		}
+	}
+
+	return result
+}
+
+// collectFile скачивает один файл приложения в <out>/<server>/<app>/<путь>
+func collectFile(conn *ssh.Client, sftpClient *sftp.Client, server, app, rel string, collect *collectConfig, state *downloadState) fileResult {
+	result := fileResult{App: app, Path: rel}
+	if state.isDone(server, app, rel) {
+		result.Status = statusSkipped
+		return result
+	}
+
+	remotePath := path.Join(collect.BaseDir, app, rel)
+	localPath := filepath.Join(collect.LocalBaseDir, server, app, filepath.FromSlash(rel))
+
+	// Скачивание файла по SFTP или с помощью cat
+	sum, err := downloadFile(conn, sftpClient, remotePath, localPath)
+	if err == nil {
+		err = writeChecksum(localPath, sum)
+	}
+	switch {
+	case errors.Is(err, errRemoteNotFound):
+		// Файл пропал между поиском и скачиванием
+		log.Printf("  [%s/%s] %s not found", server, app, rel)
+		result.Status = statusMissing
+	case err != nil:
+		log.Printf("  [%s/%s] Error downloading %s: %v", server, app, rel, err)
+		result.Status = statusFailed
+		result.Err = err
+	default:
+		log.Printf("  [%s/%s] Downloaded %s (sha256 %s)", server, app, rel, sum)
+		result.Status = statusDownloaded
+		if err := state.markDone(server, app, rel); err != nil {
+			log.Printf("  [%s/%s] Failed to save state: %v", server, app, err)
+		}
+	}
+	return result
+}
+
+// printSummary печатает итог по всем серверам и возвращает true, если ошибок не было
+func printSummary(results []serverResult) bool {
+	var unreachable, serverErrors, missing, failed []string
+	counts := map[string]int{}
+
+	for _, res := range results {
+		switch {
+		case res.Unreachable:
+			unreachable = append(unreachable, fmt.Sprintf("%s: %v", res.Server, res.Err))
+		case res.Err != nil:
+			serverErrors = append(serverErrors, fmt.Sprintf("%s: %v", res.Server, res.Err))
+		}
+
+		for _, file := range res.Files {
+			counts[file.Status]++
+			switch file.Status {
+			case statusMissing:
+				missing = append(missing, fmt.Sprintf("%s/%s: %s", res.Server, file.App, file.Path))
+			case statusFailed:
+				failed = append(failed, fmt.Sprintf("%s/%s: %s: %v", res.Server, file.App, file.Path, file.Err))
+			}
+		}
+	}
+
+	fmt.Println("==============================================")
+	fmt.Printf("Servers: %d total, %d unreachable, %d with errors\n",
+		len(results), len(unreachable), len(serverErrors))
+	fmt.Printf("Files: %d downloaded, %d skipped (done in previous run), %d patterns without matches, %d failed\n",
+		counts[statusDownloaded], counts[statusSkipped], counts[statusMissing], counts[statusFailed])
+
+	printSection("Unreachable servers", unreachable)
+	printSection("Server errors", serverErrors)
+	printSection("Apps without matching files", missing)
+	printSection("Failed downloads", failed)
+
+	return len(unreachable) == 0 && len(serverErrors) == 0 && len(failed) == 0
+}
+
+func printSection(title string, lines []string) {
+	if len(lines) == 0 {
+		return
+	}
+	sort.Strings(lines)
+	fmt.Printf("\n%s (%d):\n", title, len(lines))
+	for _, line := range lines {
+		fmt.Printf("  %s\n", line)
+	}
+}
+
+// validate проверяет шаблоны; они подставляются в shell-команды при работе через cat,
+// поэтому допускаются только символы путей и glob-символы
+func (c *collectConfig) validate() error {
+	if !path.IsAbs(c.BaseDir) {
+		return fmt.Errorf("base directory %q must be absolute", c.BaseDir)
+	}
+	if len(c.FilePatterns) == 0 {
+		return errors.New("no file patterns given")
+	}
+	if _, err := path.Match(c.AppPattern, ""); err != nil {
+		return fmt.Errorf("bad application pattern %q: %w", c.AppPattern, err)
+	}
+	for _, pattern := range c.FilePatterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad file pattern %q: %w", pattern, err)
+		}
+		if path.IsAbs(pattern) || strings.HasPrefix(path.Clean(pattern), "..") {
+			return fmt.Errorf("file pattern %q must be relative to the application directory", pattern)
+		}
+		if strings.ContainsFunc(pattern, func(r rune) bool {
+			return !strings.ContainsRune(patternChars, r)
+		}) {
+			return fmt.Errorf("file pattern %q contains unsupported characters", pattern)
+		}
+	}
+	return nil
+}
+
+// listApplications возвращает каталоги в baseDir, имена которых подходят под шаблон
+func listApplications(conn *ssh.Client, sftpClient *sftp.Client, baseDir, pattern string) ([]string, error) {
+	var names []string
+	if sftpClient != nil {
+		entries, err := sftpClient.ReadDir(baseDir)
+		if err != nil {
+			return nil, fmt.Errorf("sftp readdir failed: %w", err)
+		}
+		for _, entry := range entries {
+			// Ссылки на каталоги тоже считаются приложениями
+			if entry.Mode()&fs.ModeSymlink != 0 {
+				if info, err := sftpClient.Stat(path.Join(baseDir, entry.Name())); err == nil {
+					entry = info
+				}
+			}
+			if entry.IsDir() {
+				names = append(names, entry.Name())
+			}
+		}
+	} else {
+		// Выполнение команды для получения списка приложений
+		output, err := runCommand(conn, fmt.Sprintf(`cd %s && for d in *; do [ -d "$d" ] && printf '%%s\n' "$d"; done; true`, escapeShellArg(baseDir)))
+		if err != nil {
+			return nil, fmt.Errorf("command failed: %w", err)
+		}
+		names = splitOutputLines(output)
+	}
+
+	var apps []string
+	for _, name := range names {
+		if ok, _ := path.Match(pattern, name); ok {
+			apps = append(apps, name)
+		}
+	}
+	sort.Strings(apps)
+	return apps, nil
+}
+
+// listAppFiles возвращает обычные файлы в appDir, подходящие под шаблон,
+// в виде путей относительно appDir
+func listAppFiles(conn *ssh.Client, sftpClient *sftp.Client, appDir, pattern string) ([]string, error) {
+	var files []string
+	if sftpClient != nil {
+		matches, err := sftpClient.Glob(path.Join(appDir, pattern))
+		if err != nil {
+			return nil, fmt.Errorf("sftp glob failed: %w", err)
+		}
+		for _, match := range matches {
+			info, err := sftpClient.Stat(match)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			files = append(files, strings.TrimPrefix(match, appDir+"/"))
+		}
+	} else {
+		// Шаблон намеренно не экранируется, чтобы его раскрыл shell (см. validate)
+		output, err := runCommand(conn, fmt.Sprintf(`cd %s 2>/dev/null || exit 0; for f in %s; do [ -f "$f" ] && printf '%%s\n' "$f"; done; true`, escapeShellArg(appDir), pattern))
+		if err != nil {
+			return nil, fmt.Errorf("command failed: %w", err)
+		}
+		files = splitOutputLines(output)
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+func splitOutputLines(output []byte) []string {
+	var lines []string
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// downloadFile скачивает файл по SFTP, а при отсутствии SFTP - через cat.
+// Возвращает SHA-256 скачанного содержимого.
+func downloadFile(conn *ssh.Client, sftpClient *sftp.Client, remotePath, localPath string) (string, error) {
+	if sftpClient != nil {
+		return downloadViaSFTP(sftpClient, remotePath, localPath)
+	}
+	return downloadViaCat(conn, remotePath, localPath)
+}
+
+func downloadViaSFTP(client *sftp.Client, remotePath, localPath string) (string, error) {
+	src, err := client.Open(remotePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", errRemoteNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("sftp open failed: %w", err)
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return "", fmt.Errorf("sftp stat failed: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", remotePath)
+	}
+
+	return writeFileAtomic(localPath, info.Mode().Perm(), info.ModTime(), func(w io.Writer) error {
+		n, err := io.Copy(w, src)
+		if err != nil {
+			return fmt.Errorf("sftp read failed: %w", err)
+		}
+		if n != info.Size() {
+			return fmt.Errorf("size mismatch: got %d bytes, expected %d", n, info.Size())
+		}
+		return nil
+	})
+}
 
-		// Скачивание файла с помощью cat
-		if err := downloadViaCat(conn, remotePath, localPath); err != nil {
-			log.Printf("  [%s] Error: %v", app, err)
+func downloadViaCat(conn *ssh.Client, remotePath, localPath string) (string, error) {
+	// Экранирование пути для безопасной передачи;
+	// код 3 означает, что файла нет на сервере
+	escapedPath := escapeShellArg(remotePath)
+
+	// Права, время изменения и размер файла (GNU stat); без них файл всё равно скачивается
+	mode := os.FileMode(0644)
+	var mtime time.Time
+	size := int64(-1)
+	statOut, err := runCommand(conn, fmt.Sprintf("test -f %s || exit 3; stat -c '%%a %%Y %%s' %s", escapedPath, escapedPath))
+	if err != nil {
+		var exitErr *ssh.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitStatus() == 3 {
+			return "", errRemoteNotFound
+		}
+		log.Printf("  stat %s failed, permissions and mtime will not be preserved: %v", remotePath, err)
+	} else {
+		var perm uint32
+		var unix int64
+		if _, err := fmt.Sscanf(string(statOut), "%o %d %d", &perm, &unix, &size); err == nil {
+			mode = os.FileMode(perm).Perm()
+			mtime = time.Unix(unix, 0)
 		} else {
-			log.Printf("  [%s] Downloaded successfully", app)
+			size = -1
 		}
 	}
 
+	return writeFileAtomic(localPath, mode, mtime, func(w io.Writer) error {
+		// Создание SSH-сессии
+		session, err := conn.NewSession()
+		if err != nil {
+			return fmt.Errorf("session creation failed: %w", err)
+		}
+		defer session.Close()
+
+		// Перенаправление вывода команды в файл
+		counter := &countingWriter{w: w}
+		session.Stdout = counter
+
+		// Выполнение команды
+		if err := session.Run(fmt.Sprintf("test -f %s || exit 3; cat %s", escapedPath, escapedPath)); err != nil {
+			var exitErr *ssh.ExitError
+			if errors.As(err, &exitErr) && exitErr.ExitStatus() == 3 {
+				return errRemoteNotFound
+			}
+			return fmt.Errorf("command execution failed: %w", err)
+		}
+		if size >= 0 && counter.n != size {
+			return fmt.Errorf("size mismatch: got %d bytes, expected %d", counter.n, size)
+		}
+		return nil
+	})
+}
+
+// writeFileAtomic пишет содержимое во временный файл рядом с localPath и переименовывает
+// его только после успешного скачивания, так что при ошибке не остаётся пустых или
+// обрезанных файлов. Возвращает SHA-256 записанного содержимого.
+func writeFileAtomic(localPath string, mode os.FileMode, mtime time.Time, fill func(w io.Writer) error) (string, error) {
+	// Создание локальной директории
+	dir := filepath.Dir(localPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create local directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(localPath)+".*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("failed to create file: %w", err)
+	}
+	tmpPath := tmp.Name()
+
+	hasher := sha256.New()
+	err = fill(io.MultiWriter(tmp, hasher))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, mode)
+	}
+	if err == nil && !mtime.IsZero() {
+		err = os.Chtimes(tmpPath, mtime, mtime)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, localPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// writeChecksum сохраняет SHA-256 рядом с файлом в <name>.sha256 (формат sha256sum)
+func writeChecksum(localPath, sum string) error {
+	checksum := fmt.Sprintf("%s  %s\n", sum, filepath.Base(localPath))
+	if err := os.WriteFile(localPath+".sha256", []byte(checksum), 0644); err != nil {
+		return fmt.Errorf("failed to write checksum: %w", err)
+	}
 	return nil
 }
 
-func listApplications(conn *ssh.Client) ([]string, error) {
+// countingWriter считает количество записанных байт
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// runCommand выполняет команду на сервере и возвращает её stdout
+func runCommand(conn *ssh.Client, cmd string) ([]byte, error) {
 	session, err := conn.NewSession()
 	if err != nil {
 		return nil, fmt.Errorf("session creation failed: %w", err)
 	}
 	defer session.Close()
 
-	// Выполнение команды для получения списка приложений
-	output, err := session.Output("ls -1 /opt/solar")
+	return session.Output(cmd)
+}
+
+// runInventory разбирает все context.xml в каталоге загрузок и выводит JDBC-ресурсы
+func runInventory(localBaseDir, format, outputFile string) error {
+	if format != "csv" && format != "json" {
+		return fmt.Errorf("unknown format %q", format)
+	}
+
+	var datasources []datasource
+	err := walkDownloads(localBaseDir, func(server, app, rel, localPath string) {
+		if path.Base(rel) != "context.xml" {
+			return
+		}
+		found, err := parseContextXML(localPath)
+		if err != nil {
+			log.Printf("  [%s/%s] Failed to parse %s: %v", server, app, rel, err)
+			return
+		}
+		for _, ds := range found {
+			ds.Server, ds.App, ds.File = server, app, rel
+			datasources = append(datasources, ds)
+		}
+	})
 	if err != nil {
-		return nil, fmt.Errorf("command failed: %w", err)
+		return err
 	}
 
-	var apps []string
-	scanner := bufio.NewScanner(strings.NewReader(string(output)))
-	for scanner.Scan() {
-		app := strings.TrimSpace(scanner.Text())
-		if app != "" {
-			apps = append(apps, app)
+	out := os.Stdout
+	if outputFile != "" {
+		file, err := os.Create(outputFile)
+		if err != nil {
+			return err
 		}
+		defer file.Close()
+		out = file
 	}
 
-	return apps, nil
+	if format == "json" {
+		// Ключи верхнего уровня - сервер, затем приложение
+		inventory := map[string]map[string][]datasource{}
+		for _, ds := range datasources {
+			if inventory[ds.Server] == nil {
+				inventory[ds.Server] = map[string][]datasource{}
+			}
+			inventory[ds.Server][ds.App] = append(inventory[ds.Server][ds.App], ds)
+		}
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		encoder.SetEscapeHTML(false)
+		return encoder.Encode(inventory)
+	}
+
+	writer := csv.NewWriter(out)
+	writer.Write([]string{"server", "app", "file", "name", "type", "driverClassName", "url",
+		"username", "password", "maxTotal", "maxIdle", "validationQuery"})
+	for _, ds := range datasources {
+		writer.Write([]string{ds.Server, ds.App, ds.File, ds.Name, ds.Type, ds.DriverClassName, ds.URL,
+			ds.Username, ds.Password, ds.MaxTotal, ds.MaxIdle, ds.ValidationQuery})
+	}
+	writer.Flush()
+	return writer.Error()
 }
 
-func downloadViaCat(conn *ssh.Client, remotePath, localPath string) error {
-	// Создание локальной директории
-	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
-		return fmt.Errorf("failed to create local directory: %w", err)
+// walkDownloads обходит каталог загрузок <out>/<server>/<app>/<путь> и вызывает fn
+// для каждого скачанного файла; служебные файлы (состояние, контрольные суммы) пропускаются
+func walkDownloads(localBaseDir string, fn func(server, app, rel, localPath string)) error {
+	return filepath.WalkDir(localBaseDir, func(localPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".sha256") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(localBaseDir, localPath)
+		if err != nil {
+			return err
+		}
+		parts := strings.SplitN(filepath.ToSlash(rel), "/", 3)
+		if len(parts) < 3 {
+			return nil
+		}
+		fn(parts[0], parts[1], parts[2], localPath)
+		return nil
+	})
+}
+
+// parseContextXML извлекает JDBC-ресурсы из context.xml. Учитываются варианты имён
+// атрибутов DBCP 1/2 (maxActive/maxTotal) и HikariCP (jdbcUrl, maximumPoolSize).
+func parseContextXML(localPath string) ([]datasource, error) {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var datasources []datasource
+	decoder := xml.NewDecoder(file)
+	decoder.Strict = false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		element, ok := token.(xml.StartElement)
+		if !ok || element.Name.Local != "Resource" {
+			continue
+		}
+
+		attrs := map[string]string{}
+		for _, attr := range element.Attr {
+			attrs[attr.Name.Local] = attr.Value
+		}
+		url := firstAttr(attrs, "url", "jdbcUrl")
+		if url == "" && !strings.Contains(attrs["type"], "DataSource") {
+			// Не JDBC-ресурс (например, mail session)
+			continue
+		}
+
+		ds := datasource{
+			Name:            attrs["name"],
+			Type:            attrs["type"],
+			DriverClassName: firstAttr(attrs, "driverClassName", "dataSourceClassName"),
+			URL:             maskURL(url),
+			Username:        firstAttr(attrs, "username", "user"),
+			MaxTotal:        firstAttr(attrs, "maxTotal", "maxActive", "maximumPoolSize"),
+			MaxIdle:         attrs["maxIdle"],
+			ValidationQuery: firstAttr(attrs, "validationQuery", "connectionTestQuery"),
+		}
+		if firstAttr(attrs, "password") != "" {
+			ds.Password = passwordMask
+		}
+		datasources = append(datasources, ds)
 	}
 
-	// Создание файла для записи
-	file, err := os.Create(localPath)
+	return datasources, nil
+}
+
+// xmlNode - нормализованный элемент XML: атрибуты без учёта порядка,
+// текст без лишних пробелов, комментарии отброшены
+type xmlNode struct {
+	Name     string
+	Attrs    map[string]string
+	Text     string
+	Children []*xmlNode
+}
+
+// configVariant - группа серверов с одинаковым нормализованным содержимым файла
+type configVariant struct {
+	Hash    string
+	Tree    *xmlNode
+	Servers []string
+}
+
+// secretName определяет атрибуты и элементы, значения которых сравниваются только по хэшу
+var secretName = regexp.MustCompile(`(?i)pass|secret|token|credential|private.?key`)
+
+// runDrift группирует серверы по нормализованному содержимому каждого XML-файла
+// приложения и печатает отличия от варианта большинства
+func runDrift(localBaseDir string) error {
+	variants := map[string]map[string]*configVariant{} // app/путь -> хэш -> вариант
+	failures := map[string][]string{}                  // app/путь -> ошибки разбора
+	err := walkDownloads(localBaseDir, func(server, app, rel, localPath string) {
+		if !strings.HasSuffix(rel, ".xml") {
+			return
+		}
+		key := app + "/" + rel
+
+		tree, err := parseXMLFile(localPath)
+		if err != nil {
+			failures[key] = append(failures[key], fmt.Sprintf("%s: %v", server, err))
+			return
+		}
+
+		hash := hashString(canonicalXML(tree))
+		if variants[key] == nil {
+			variants[key] = map[string]*configVariant{}
+		}
+		if variants[key][hash] == nil {
+			variants[key][hash] = &configVariant{Hash: hash, Tree: tree}
+		}
+		variants[key][hash].Servers = append(variants[key][hash].Servers, server)
+	})
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	for key := range variants {
+		keys = append(keys, key)
+	}
+	for key := range failures {
+		if variants[key] == nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	drifted := 0
+	for _, key := range keys {
+		// Большинство - самая многочисленная группа; при равенстве - с меньшим именем сервера
+		var groups []*configVariant
+		total := 0
+		for _, variant := range variants[key] {
+			sort.Strings(variant.Servers)
+			groups = append(groups, variant)
+			total += len(variant.Servers)
+		}
+		sort.Slice(groups, func(i, j int) bool {
+			if len(groups[i].Servers) != len(groups[j].Servers) {
+				return len(groups[i].Servers) > len(groups[j].Servers)
+			}
+			return groups[i].Servers[0] < groups[j].Servers[0]
+		})
+
+		if len(groups) <= 1 && len(failures[key]) == 0 {
+			fmt.Printf("= %s: consistent across %d servers\n", key, total)
+			continue
+		}
+
+		drifted++
+		fmt.Printf("\n! %s: %d variants across %d servers\n", key, len(groups), total)
+		for i, group := range groups {
+			if i == 0 {
+				fmt.Printf("  majority (%d): %s\n", len(group.Servers), strings.Join(group.Servers, ", "))
+				continue
+			}
+			fmt.Printf("  variant %d (%d): %s\n", i+1, len(group.Servers), strings.Join(group.Servers, ", "))
+			var changes []string
+			diffXML(groups[0].Tree.Name, groups[0].Tree, group.Tree, &changes)
+			for _, change := range changes {
+				fmt.Printf("    %s\n", change)
+			}
+		}
+		for _, failure := range failures[key] {
+			fmt.Printf("  unparsable: %s\n", failure)
+		}
+	}
+
+	fmt.Printf("\n%d of %d config files differ between servers\n", drifted, len(keys))
+	return nil
+}
+
+func parseXMLFile(localPath string) (*xmlNode, error) {
+	file, err := os.Open(localPath)
 	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+		return nil, err
 	}
 	defer file.Close()
 
-	// Создание SSH-сессии
-	session, err := conn.NewSession()
+	return parseXMLTree(file)
+}
+
+// parseXMLTree строит нормализованное дерево XML; значения секретных атрибутов
+// и элементов заменяются их SHA-256
+func parseXMLTree(r io.Reader) (*xmlNode, error) {
+	decoder := xml.NewDecoder(r)
+	decoder.Strict = false
+
+	var root *xmlNode
+	var stack []*xmlNode
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			node := &xmlNode{Name: t.Name.Local, Attrs: map[string]string{}}
+			for _, attr := range t.Attr {
+				if attr.Name.Space == "xmlns" || attr.Name.Local == "xmlns" {
+					continue
+				}
+				value := strings.TrimSpace(attr.Value)
+				if secretName.MatchString(attr.Name.Local) {
+					value = secretHash(value)
+				} else {
+					value = hashURLPassword(value)
+				}
+				node.Attrs[attr.Name.Local] = value
+			}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, node)
+			} else if root == nil {
+				root = node
+			}
+			stack = append(stack, node)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				node := stack[len(stack)-1]
+				if secretName.MatchString(node.Name) && node.Text != "" {
+					node.Text = secretHash(node.Text)
+				}
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			if len(stack) > 0 {
+				if text := strings.Join(strings.Fields(string(t)), " "); text != "" {
+					node := stack[len(stack)-1]
+					node.Text = strings.TrimSpace(node.Text + " " + text)
+				}
+			}
+		}
+	}
+
+	if root == nil {
+		return nil, errors.New("no root element")
+	}
+	return root, nil
+}
+
+// canonicalXML сериализует дерево с отсортированными атрибутами
+func canonicalXML(node *xmlNode) string {
+	var b strings.Builder
+	var write func(n *xmlNode)
+	write = func(n *xmlNode) {
+		b.WriteString("<" + n.Name)
+		for _, name := range sortedKeys(n.Attrs) {
+			fmt.Fprintf(&b, " %s=%q", name, n.Attrs[name])
+		}
+		b.WriteString(">")
+		if n.Text != "" {
+			fmt.Fprintf(&b, "%q", n.Text)
+		}
+		for _, child := range n.Children {
+			write(child)
+		}
+		b.WriteString("</" + n.Name + ">")
+	}
+	write(node)
+	return b.String()
+}
+
+// diffXML записывает в changes структурные отличия b от a:
+// "- путь" - элемент есть только в a, "+ путь" - только в b, "~ путь" - изменён
+func diffXML(nodePath string, a, b *xmlNode, changes *[]string) {
+	if a.Name != b.Name {
+		*changes = append(*changes, fmt.Sprintf("~ %s element: %s -> %s", nodePath, a.Name, b.Name))
+		return
+	}
+
+	for _, name := range sortedKeys(a.Attrs) {
+		newValue, ok := b.Attrs[name]
+		switch {
+		case !ok:
+			*changes = append(*changes, fmt.Sprintf("- %s @%s=%q", nodePath, name, a.Attrs[name]))
+		case newValue != a.Attrs[name]:
+			*changes = append(*changes, fmt.Sprintf("~ %s @%s: %q -> %q", nodePath, name, a.Attrs[name], newValue))
+		}
+	}
+	for _, name := range sortedKeys(b.Attrs) {
+		if _, ok := a.Attrs[name]; !ok {
+			*changes = append(*changes, fmt.Sprintf("+ %s @%s=%q", nodePath, name, b.Attrs[name]))
+		}
+	}
+	if a.Text != b.Text {
+		*changes = append(*changes, fmt.Sprintf("~ %s text: %q -> %q", nodePath, a.Text, b.Text))
+	}
+
+	// Дочерние элементы сопоставляются по ключу (имя + name/id/path/className или порядковый номер)
+	aKeys, aChildren := childKeys(a)
+	bKeys, bChildren := childKeys(b)
+	for _, key := range aKeys {
+		if bChild, ok := bChildren[key]; ok {
+			diffXML(nodePath+"/"+key, aChildren[key], bChild, changes)
+		} else {
+			*changes = append(*changes, fmt.Sprintf("- %s/%s", nodePath, key))
+		}
+	}
+	for _, key := range bKeys {
+		if _, ok := aChildren[key]; !ok {
+			*changes = append(*changes, fmt.Sprintf("+ %s/%s", nodePath, key))
+		}
+	}
+}
+
+// childKeys возвращает ключи дочерних элементов в исходном порядке
+func childKeys(node *xmlNode) ([]string, map[string]*xmlNode) {
+	var keys []string
+	children := map[string]*xmlNode{}
+	seen := map[string]int{}
+	for _, child := range node.Children {
+		key := child.Name
+		if id := firstAttr(child.Attrs, "name", "id", "path", "className"); id != "" {
+			key = fmt.Sprintf("%s[%s]", child.Name, id)
+		}
+		seen[key]++
+		if seen[key] > 1 {
+			key = fmt.Sprintf("%s#%d", key, seen[key])
+		}
+		keys = append(keys, key)
+		children[key] = child
+	}
+	return keys, children
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func hashString(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// secretHash заменяет секрет префиксом его SHA-256, достаточным для сравнения
+func secretHash(value string) string {
+	if value == "" {
+		return ""
+	}
+	return "sha256:" + hashString(value)[:16]
+}
+
+// hashURLPassword заменяет пароль внутри JDBC URL его хэшем
+func hashURLPassword(value string) string {
+	value = urlPasswordParam.ReplaceAllStringFunc(value, func(m string) string {
+		name, secret, _ := strings.Cut(m, "=")
+		return name + "=" + secretHash(secret)
+	})
+	value = urlPasswordOracle.ReplaceAllStringFunc(value, func(m string) string {
+		userinfo := strings.TrimSuffix(m, "@")
+		i := strings.LastIndex(userinfo, "/")
+		return userinfo[:i+1] + secretHash(userinfo[i+1:]) + "@"
+	})
+	return urlPasswordUserInfo.ReplaceAllStringFunc(value, func(m string) string {
+		userinfo := strings.TrimSuffix(m, "@")
+		i := strings.LastIndex(userinfo, ":")
+		return userinfo[:i+1] + secretHash(userinfo[i+1:]) + "@"
+	})
+}
+
+// passwordMask подставляется вместо паролей в выводе
+const passwordMask = "****"
+
+var (
+	urlPasswordParam    = regexp.MustCompile(`(?i)(password=)[^&;]*`)
+	urlPasswordUserInfo = regexp.MustCompile(`(//[^/:@]+:)[^@/]*@`)
+	// Oracle thin: jdbc:oracle:thin:user/password@host:port:SID или @//host/service
+	urlPasswordOracle = regexp.MustCompile(`(?i)(jdbc:oracle:\w+:[^/:@]+/)[^@]*@`)
+)
+
+// maskURL скрывает пароль в JDBC URL (параметр password=..., user:password@host
+// или user/password@ у Oracle)
+func maskURL(url string) string {
+	url = urlPasswordParam.ReplaceAllString(url, "${1}"+passwordMask)
+	url = urlPasswordOracle.ReplaceAllString(url, "${1}"+passwordMask+"@")
+	return urlPasswordUserInfo.ReplaceAllString(url, "${1}"+passwordMask+"@")
+}
+
+func firstAttr(attrs map[string]string, names ...string) string {
+	for _, name := range names {
+		if value := attrs[name]; value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// snapshot - манифест снимка загрузок одного запуска: путь сервер/приложение/файл -> SHA-256.
+// Содержимое файлов хранится в <snapshots>/objects по хэшу, поэтому неизменившиеся
+// файлы не занимают место повторно. Uncollected - серверы и файлы, которые в этом
+// запуске получить не удалось: их отсутствие в Files не означает удаления
+type snapshot struct {
+	ID          string            `json:"id"`
+	Time        time.Time         `json:"time"`
+	Files       map[string]string `json:"files"`
+	Uncollected []string          `json:"uncollected,omitempty"`
+
+	newObjects int
+}
+
+// collected сообщает, был ли путь сервер/приложение/файл получен в запуске снимка
+func (s *snapshot) collected(key string) bool {
+	if _, ok := s.Files[key]; ok {
+		return true
+	}
+	for _, prefix := range s.Uncollected {
+		if key == prefix || strings.HasPrefix(key, prefix+"/") {
+			return false
+		}
+	}
+	return true
+}
+
+// takeSnapshot сохраняет файлы, полученные в этом запуске (скачанные и
+// пропущенные с -resume), как новый снимок. Содержимое каталога загрузок от
+// прошлых запусков в снимок не попадает
+func takeSnapshot(localBaseDir, snapshotDir string, results []serverResult) (*snapshot, error) {
+	now := time.Now()
+	snap := &snapshot{Time: now, Files: map[string]string{}}
+
+	for _, res := range results {
+		if res.Err != nil {
+			snap.Uncollected = append(snap.Uncollected, res.Server)
+		}
+		for _, file := range res.Files {
+			key := res.Server + "/" + file.App + "/" + file.Path
+			switch file.Status {
+			case statusDownloaded, statusSkipped:
+			case statusFailed:
+				// Не удалось получить список по шаблону - неизвестно, какие файлы
+				// приложения есть на сервере
+				if strings.ContainsAny(file.Path, "*?[") {
+					key = res.Server + "/" + file.App
+				}
+				snap.Uncollected = append(snap.Uncollected, key)
+				continue
+			default:
+				continue
+			}
+
+			localPath := filepath.Join(localBaseDir, res.Server, file.App, filepath.FromSlash(file.Path))
+			sum, created, err := storeObject(snapshotDir, localPath)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", localPath, err)
+			}
+			if created {
+				snap.newObjects++
+			}
+			snap.Files[key] = sum
+		}
+	}
+	sort.Strings(snap.Uncollected)
+
+	runsDir := filepath.Join(snapshotDir, "runs")
+	if err := os.MkdirAll(runsDir, 0755); err != nil {
+		return nil, err
+	}
+
+	// Файл манифеста создаётся эксклюзивно: запуск в ту же секунду получает суффикс
+	var runPath string
+	for i := 1; ; i++ {
+		snap.ID = now.Format("20060102-150405")
+		if i > 1 {
+			snap.ID = fmt.Sprintf("%s-%d", snap.ID, i)
+		}
+		runPath = filepath.Join(runsDir, snap.ID+".json")
+		file, err := os.OpenFile(runPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		file.Close()
+		break
+	}
+
+	data, err := json.MarshalIndent(snap, "", "  ")
 	if err != nil {
-		return fmt.Errorf("session creation failed: %w", err)
+		return nil, err
 	}
-	defer session.Close()
+	if err := os.WriteFile(runPath+".tmp", data, 0644); err != nil {
+		return nil, err
+	}
+	return snap, os.Rename(runPath+".tmp", runPath)
+}
 
-	// Перенаправление вывода команды в файл
-	session.Stdout = file
+// storeObject копирует файл в хранилище объектов, если такого содержимого там ещё нет
+func storeObject(snapshotDir, localPath string) (string, bool, error) {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return "", false, err
+	}
+	defer file.Close()
 
-	// Экранирование пути для безопасной передачи
-	escapedPath := escapeShellArg(remotePath)
-	cmd := fmt.Sprintf("cat %s", escapedPath)
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", false, err
+	}
+	sum := hex.EncodeToString(hasher.Sum(nil))
+
+	objectPath := objectPath(snapshotDir, sum)
+	if _, err := os.Stat(objectPath); err == nil {
+		return sum, false, nil
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", false, err
+	}
+	_, err = writeFileAtomic(objectPath, 0444, time.Time{}, func(w io.Writer) error {
+		_, err := io.Copy(w, file)
+		return err
+	})
+	if err != nil {
+		return "", false, err
+	}
+	return sum, true, nil
+}
+
+func objectPath(snapshotDir, sum string) string {
+	return filepath.Join(snapshotDir, "objects", sum[:2], sum[2:])
+}
+
+// loadSnapshots читает манифесты всех снимков, отсортированные по времени
+func loadSnapshots(snapshotDir string) ([]*snapshot, error) {
+	paths, err := filepath.Glob(filepath.Join(snapshotDir, "runs", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	var snapshots []*snapshot
+	for _, runPath := range paths {
+		data, err := os.ReadFile(runPath)
+		if err != nil {
+			return nil, err
+		}
+		snap := &snapshot{}
+		if err := json.Unmarshal(data, snap); err != nil {
+			return nil, fmt.Errorf("invalid snapshot %s: %w", runPath, err)
+		}
+		snapshots = append(snapshots, snap)
+	}
+	// Суффикс ID запуска в ту же секунду нарушает порядок имён файлов
+	sort.SliceStable(snapshots, func(i, j int) bool { return snapshots[i].Time.Before(snapshots[j].Time) })
+	return snapshots, nil
+}
+
+func listSnapshots(snapshotDir string) error {
+	snapshots, err := loadSnapshots(snapshotDir)
+	if err != nil {
+		return err
+	}
+	for _, snap := range snapshots {
+		fmt.Printf("%s  %s  %d files\n", snap.ID, snap.Time.Format(time.RFC3339), len(snap.Files))
+	}
+	return nil
+}
+
+// runChanges печатает изменения между двумя снимками по серверам и приложениям
+func runChanges(snapshotDir, fromID, toID string) error {
+	snapshots, err := loadSnapshots(snapshotDir)
+	if err != nil {
+		return err
+	}
+	if len(snapshots) < 2 && (fromID == "" || toID == "") {
+		return fmt.Errorf("need at least two snapshots in %s, found %d", snapshotDir, len(snapshots))
+	}
+
+	find := func(id string, fallback int) (*snapshot, error) {
+		if id == "" {
+			return snapshots[fallback], nil
+		}
+		for _, snap := range snapshots {
+			if snap.ID == id {
+				return snap, nil
+			}
+		}
+		return nil, fmt.Errorf("snapshot %q not found", id)
+	}
+	from, err := find(fromID, len(snapshots)-2)
+	if err != nil {
+		return err
+	}
+	to, err := find(toID, len(snapshots)-1)
+	if err != nil {
+		return err
+	}
+
+	// Все пути из обоих снимков, сгруппированные по сервер/приложение
+	paths := map[string]bool{}
+	for key := range from.Files {
+		paths[key] = true
+	}
+	for key := range to.Files {
+		paths[key] = true
+	}
+	var keys []string
+	for key := range paths {
+		if from.Files[key] != to.Files[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	fmt.Printf("Changes from %s to %s: %d files\n", from.ID, to.ID, len(keys))
+	currentGroup := ""
+	for _, key := range keys {
+		parts := strings.SplitN(key, "/", 3)
+		if group := parts[0] + "/" + parts[1]; group != currentGroup {
+			fmt.Printf("\n%s:\n", group)
+			currentGroup = group
+		}
+		rel := parts[2]
+
+		oldSum, newSum := from.Files[key], to.Files[key]
+		switch {
+		case oldSum == "" && !from.collected(key):
+			fmt.Printf("  ? %s (not collected in %s)\n", rel, from.ID)
+		case newSum == "" && !to.collected(key):
+			fmt.Printf("  ? %s (not collected in %s)\n", rel, to.ID)
+		case oldSum == "":
+			fmt.Printf("  + %s\n", rel)
+		case newSum == "":
+			fmt.Printf("  - %s\n", rel)
+		default:
+			fmt.Printf("  ~ %s\n", rel)
+			changes, err := diffObjects(snapshotDir, rel, oldSum, newSum)
+			if err != nil {
+				fmt.Printf("      (diff unavailable: %v)\n", err)
+			}
+			for _, change := range changes {
+				fmt.Printf("      %s\n", change)
+			}
+		}
+	}
+	return nil
+}
 
-	// Выполнение команды
-	if err := session.Run(cmd); err != nil {
-		return fmt.Errorf("command execution failed: %w", err)
+// maxLineDiffCells ограничивает размер таблицы для построчного diff
+const maxLineDiffCells = 4000000
+
+// diffObjects сравнивает две версии файла: XML - структурно, остальные файлы -
+// построчно; секреты в обоих случаях сравниваются по хэшу
+func diffObjects(snapshotDir, rel, oldSum, newSum string) ([]string, error) {
+	oldData, err := os.ReadFile(objectPath(snapshotDir, oldSum))
+	if err != nil {
+		return nil, err
+	}
+	newData, err := os.ReadFile(objectPath(snapshotDir, newSum))
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []string
+	if strings.HasSuffix(rel, ".xml") {
+		oldTree, oldErr := parseXMLTree(strings.NewReader(string(oldData)))
+		newTree, newErr := parseXMLTree(strings.NewReader(string(newData)))
+		if oldErr == nil && newErr == nil {
+			diffXML(oldTree.Name, oldTree, newTree, &changes)
+			if len(changes) == 0 {
+				changes = append(changes, "(formatting only)")
+			}
+			return changes, nil
+		}
+	}
+
+	oldLines := hashSecretLines(strings.Split(string(oldData), "\n"))
+	newLines := hashSecretLines(strings.Split(string(newData), "\n"))
+	if len(oldLines)*len(newLines) > maxLineDiffCells {
+		return []string{fmt.Sprintf("(too large for line diff: sha256 %s -> %s)", oldSum[:12], newSum[:12])}, nil
+	}
+	return diffLines(oldLines, newLines), nil
+}
+
+var (
+	// secretKeyValue - "key: value" (yml), "key=value" (properties, setenv.sh, атрибуты XML)
+	secretKeyValue = regexp.MustCompile(`([\w.-]+)(\s*[:=]\s*)("[^"]*"|'[^']*'|[^\s"'#;,&<>]+)`)
+	// secretElement - <password>value</password> в XML, который не удалось разобрать
+	secretElement = regexp.MustCompile(`<([\w.:-]+)>([^<]*)</([\w.:-]+)>`)
+)
+
+// hashSecretLines заменяет хэшем пароли в URL и значения ключей, похожих на секреты,
+// чтобы построчный diff не печатал их открытым текстом
+func hashSecretLines(lines []string) []string {
+	hashed := make([]string, len(lines))
+	for i, line := range lines {
+		hashed[i] = hashSecretLine(line)
+	}
+	return hashed
+}
+
+func hashSecretLine(line string) string {
+	line = secretKeyValue.ReplaceAllStringFunc(line, func(m string) string {
+		parts := secretKeyValue.FindStringSubmatch(m)
+		key, sep, value := parts[1], parts[2], parts[3]
+		quote := ""
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') {
+			quote, value = value[:1], value[1:len(value)-1]
+		}
+		if !secretName.MatchString(key) {
+			// значение в кавычках может само состоять из пар key=value (JAVA_OPTS)
+			if quote != "" {
+				return key + sep + quote + hashSecretLine(value) + quote
+			}
+			return hashURLPassword(m)
+		}
+		return key + sep + quote + secretHash(value) + quote
+	})
+	return secretElement.ReplaceAllStringFunc(line, func(m string) string {
+		parts := secretElement.FindStringSubmatch(m)
+		if parts[1] != parts[3] || !secretName.MatchString(parts[1]) || parts[2] == "" {
+			return m
+		}
+		return "<" + parts[1] + ">" + secretHash(parts[2]) + "</" + parts[3] + ">"
+	})
+}
+
+// diffLines строит построчный diff по наибольшей общей подпоследовательности
+func diffLines(a, b []string) []string {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var changes []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			changes = append(changes, "- "+a[i])
+			i++
+		default:
+			changes = append(changes, "+ "+b[j])
+			j++
+		}
+	}
+	return changes
+}
+
+// loadState читает файл состояния; отсутствующий файл означает пустое состояние
+func loadState(path string) (*downloadState, error) {
+	state := &downloadState{path: path, Started: time.Now(), Done: map[string]time.Time{}}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
 	}
 
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %w", path, err)
+	}
+	if state.Done == nil {
+		state.Done = map[string]time.Time{}
+	}
+	return state, nil
+}
+
+func stateKey(server, app, rel string) string {
+	return server + "/" + app + "/" + rel
+}
+
+func (s *downloadState) isDone(server, app, rel string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.Done[stateKey(server, app, rel)]
+	return ok
+}
+
+// markDone отмечает файл как скачанный и сразу сохраняет состояние
+func (s *downloadState) markDone(server, app, rel string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Done[stateKey(server, app, rel)] = time.Now()
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+
+	// Запись через временный файл, чтобы не повредить состояние при падении
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
+
+func (s *downloadState) remove() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	return nil
 }
 
@@ -172,4 +1571,4 @@ func readLines(filename string) ([]string, error) {
 		}
 	}
 	return result, nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMaskURL(t *testing.T) {
+	tests := []struct {
+		name, url, want string
+	}{
+		{"password param", "jdbc:postgresql://db:5432/app?user=app&password=secret&ssl=true",
+			"jdbc:postgresql://db:5432/app?user=app&password=****&ssl=true"},
+		{"userinfo", "jdbc:mysql://app:secret@db:3306/app",
+			"jdbc:mysql://app:****@db:3306/app"},
+		{"oracle thin sid", "jdbc:oracle:thin:scott/tiger@db:1521:ORCL",
+			"jdbc:oracle:thin:scott/****@db:1521:ORCL"},
+		{"oracle thin service", "jdbc:oracle:thin:scott/tiger@//db:1521/orcl.example.com",
+			"jdbc:oracle:thin:scott/****@//db:1521/orcl.example.com"},
+		{"oracle without password", "jdbc:oracle:thin:@db:1521:ORCL",
+			"jdbc:oracle:thin:@db:1521:ORCL"},
+		{"no password", "jdbc:postgresql://db:5432/app", "jdbc:postgresql://db:5432/app"},
+	}
+	for _, tt := range tests {
+		if got := maskURL(tt.url); got != tt.want {
+			t.Errorf("%s: maskURL(%q) = %q, want %q", tt.name, tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestHashURLPassword(t *testing.T) {
+	tests := []struct {
+		name, url, want string
+	}{
+		{"password param", "jdbc:postgresql://db:5432/app?password=secret",
+			"jdbc:postgresql://db:5432/app?password=" + secretHash("secret")},
+		{"userinfo", "jdbc:mysql://app:secret@db:3306/app",
+			"jdbc:mysql://app:" + secretHash("secret") + "@db:3306/app"},
+		{"oracle thin sid", "jdbc:oracle:thin:scott/tiger@db:1521:ORCL",
+			"jdbc:oracle:thin:scott/" + secretHash("tiger") + "@db:1521:ORCL"},
+		{"oracle thin service", "jdbc:oracle:thin:scott/tiger@//db:1521/orcl",
+			"jdbc:oracle:thin:scott/" + secretHash("tiger") + "@//db:1521/orcl"},
+	}
+	for _, tt := range tests {
+		if got := hashURLPassword(tt.url); got != tt.want {
+			t.Errorf("%s: hashURLPassword(%q) = %q, want %q", tt.name, tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestHashSecretLines(t *testing.T) {
+	tests := []struct {
+		name, line, want string
+	}{
+		{"yml", "  password: secret", "  password: " + secretHash("secret")},
+		{"yml quoted", `  client-secret: "secret"`, `  client-secret: "` + secretHash("secret") + `"`},
+		{"properties", "db.password=secret", "db.password=" + secretHash("secret")},
+		{"setenv", `export DB_PASSWORD='secret'`, `export DB_PASSWORD='` + secretHash("secret") + `'`},
+		{"java opts", `JAVA_OPTS="-Xmx1g -Djavax.net.ssl.keyStorePassword=secret"`,
+			`JAVA_OPTS="-Xmx1g -Djavax.net.ssl.keyStorePassword=` + secretHash("secret") + `"`},
+		{"xml attribute", `<Resource username="app" password="secret"/>`,
+			`<Resource username="app" password="` + secretHash("secret") + `"/>`},
+		{"xml element", "<password>secret</password>", "<password>" + secretHash("secret") + "</password>"},
+		{"url", "  url: jdbc:mysql://app:secret@db:3306/app",
+			"  url: jdbc:mysql://app:" + secretHash("secret") + "@db:3306/app"},
+		{"url password param", "url=jdbc:postgresql://db/app?user=app&password=secret",
+			"url=jdbc:postgresql://db/app?user=app&password=" + secretHash("secret")},
+		{"plain", "  port: 8080", "  port: 8080"},
+	}
+	for _, tt := range tests {
+		if got := hashSecretLines([]string{tt.line})[0]; got != tt.want {
+			t.Errorf("%s: hashSecretLines(%q) = %q, want %q", tt.name, tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestTakeSnapshot(t *testing.T) {
+	outDir, snapshotDir := t.TempDir(), t.TempDir()
+	for _, rel := range []string{"web1/app/conf/context.xml", "web1/old/conf/context.xml", "web2/app/conf/context.xml"} {
+		localPath := filepath.Join(outDir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(localPath, []byte(rel), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// web1/old остался в каталоге от прошлых запусков, web2 недоступен
+	results := []serverResult{
+		{Server: "web1", Files: []fileResult{
+			{App: "app", Path: "conf/context.xml", Status: statusDownloaded},
+			{App: "app", Path: "conf/*.yml", Status: statusFailed},
+		}},
+		{Server: "web2", Unreachable: true, Err: os.ErrDeadlineExceeded},
+	}
+	first, err := takeSnapshot(outDir, snapshotDir, results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := takeSnapshot(outDir, snapshotDir, results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ID == second.ID {
+		t.Errorf("snapshots taken in the same second share ID %s", first.ID)
+	}
+
+	if len(first.Files) != 1 || first.Files["web1/app/conf/context.xml"] == "" {
+		t.Errorf("Files = %v, want only web1/app/conf/context.xml", first.Files)
+	}
+	for key, want := range map[string]bool{
+		"web1/app/conf/context.xml": true,
+		"web1/app/conf/app.yml":     false,
+		"web1/old/conf/context.xml": true,
+		"web2/app/conf/context.xml": false,
+	} {
+		if got := first.collected(key); got != want {
+			t.Errorf("collected(%s) = %v, want %v", key, got, want)
+		}
+	}
+
+	snapshots, err := loadSnapshots(snapshotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 || snapshots[0].ID != first.ID || snapshots[1].ID != second.ID {
+		t.Errorf("loadSnapshots returned %d snapshots, want %s, %s in order", len(snapshots), first.ID, second.ID)
+	}
+}
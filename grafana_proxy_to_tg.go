@@ -3,14 +3,29 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"html"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+	"time"
+	"unicode/utf8"
 )
 
 // Конфигурация
@@ -18,30 +33,125 @@ var (
 	telegramToken   = os.Getenv("TELEGRAM_TOKEN")
 	listenPort      string
 	targetWebhook   string
+	zabbixURL       string
+	parseMode       = "plain"
 	maxMessageChars = 4096
+
+	// Текущая конфигурация маршрутизации, заменяется при перечитывании
+	routes atomic.Pointer[RoutingConfig]
+
+	// Очередь исходящих сообщений
+	queue *outboundQueue
+
+	// Клиент Bot API: без таймаута зависший запрос остановил бы всю очередь
+	telegramClient = &http.Client{Timeout: 30 * time.Second}
 )
 
 // Структура для парсинга Grafana Alert
 type GrafanaAlert struct {
-	Title       string `json:"title"`
-	Message     string `json:"message"`
-	RuleName    string `json:"ruleName"`
-	RuleURL     string `json:"ruleUrl"`
-	State       string `json:"state"`
+	Title       string            `json:"title"`
+	Message     string            `json:"message"`
+	RuleName    string            `json:"ruleName"`
+	RuleURL     string            `json:"ruleUrl"`
+	State       string            `json:"state"`
+	Tags        map[string]string `json:"tags"`
 	EvalMatches []struct {
 		Value  float64 `json:"value"`
 		Metric string  `json:"metric"`
 	} `json:"evalMatches"`
 }
 
-// Функция для отправки сообщения в Telegram
-func sendToTelegram(chatID, text string) error {
+// UnifiedPayload - webhook Grafana 9+ (unified alerting); тот же формат
+// (version 4) отправляет Prometheus Alertmanager
+type UnifiedPayload struct {
+	Version           string            `json:"version"`
+	GroupKey          string            `json:"groupKey"`
+	Receiver          string            `json:"receiver"`
+	Status            string            `json:"status"`
+	Alerts            []UnifiedAlert    `json:"alerts"`
+	GroupLabels       map[string]string `json:"groupLabels"`
+	CommonLabels      map[string]string `json:"commonLabels"`
+	CommonAnnotations map[string]string `json:"commonAnnotations"`
+	ExternalURL       string            `json:"externalURL"`
+	Title             string            `json:"title"`
+	Message           string            `json:"message"`
+	TruncatedAlerts   int               `json:"truncatedAlerts"`
+
+	source string
+}
+
+// UnifiedAlert - один алерт из UnifiedPayload
+type UnifiedAlert struct {
+	Status       string            `json:"status"`
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL"`
+	Fingerprint  string            `json:"fingerprint"`
+	SilenceURL   string            `json:"silenceURL"`
+	DashboardURL string            `json:"dashboardURL"`
+	PanelURL     string            `json:"panelURL"`
+	ValueString  string            `json:"valueString"`
+}
+
+// alertLabels - метки и аннотации одного алерта, по которым выбирается маршрут
+type alertLabels struct {
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+// webhookPayload - разобранный webhook одного источника; сам payload служит
+// данными для шаблона сообщения
+type webhookPayload interface {
+	// Source - имя источника: grafana, grafana-legacy, alertmanager или zabbix
+	Source() string
+	// alerts возвращает метки каждого алерта для маршрутизации
+	alerts() []alertLabels
+	// subset возвращает payload только с алертами с указанными номерами
+	subset(indexes []int) webhookPayload
+}
+
+// Режимы разметки: plain - без parse_mode, остальные передаются в Telegram как есть
+var parseModes = map[string]string{
+	"plain":      "plain",
+	"html":       "HTML",
+	"markdownv2": "MarkdownV2",
+}
+
+// telegramError - ответ Telegram Bot API с ошибкой
+type telegramError struct {
+	Status      string
+	StatusCode  int
+	Description string
+	RetryAfter  time.Duration // для 429 Too Many Requests
+	Body        string
+}
+
+func (e *telegramError) Error() string {
+	return fmt.Sprintf("HTTP error: %s, response: %s", e.Status, e.Body)
+}
+
+// entityError - Telegram не смог разобрать разметку сообщения
+func (e *telegramError) entityError() bool {
+	return e.StatusCode == http.StatusBadRequest && strings.Contains(e.Description, "can't parse entities")
+}
+
+// Функция для отправки сообщения в Telegram; threadID - тема форума (0 - без
+// темы), mode - режим разметки
+func sendToTelegram(chatID string, threadID int, text, mode string) error {
 	formData := url.Values{
 		"chat_id": {chatID},
 		"text":    {text},
 	}
+	if threadID != 0 {
+		formData.Set("message_thread_id", strconv.Itoa(threadID))
+	}
+	if mode != "plain" {
+		formData.Set("parse_mode", mode)
+	}
 
-	resp, err := http.PostForm(targetWebhook, formData)
+	resp, err := telegramClient.PostForm(targetWebhook, formData)
 	if err != nil {
 		return err
 	}
@@ -49,38 +159,1008 @@ func sendToTelegram(chatID, text string) error {
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("HTTP error: %s, response: %s", resp.Status, string(body))
+		var result struct {
+			Description string `json:"description"`
+			Parameters  struct {
+				RetryAfter int `json:"retry_after"`
+			} `json:"parameters"`
+		}
+		json.Unmarshal(body, &result)
+		return &telegramError{
+			Status:      resp.Status,
+			StatusCode:  resp.StatusCode,
+			Description: result.Description,
+			RetryAfter:  time.Duration(result.Parameters.RetryAfter) * time.Second,
+			Body:        string(body),
+		}
 	}
 	return nil
 }
 
-// Разбивка длинного текста на части
-func splitLongMessage(text string, maxLength int) []string {
-	var parts []string
-	lines := strings.Split(text, "\n")
-	currentPart := ""
+// msgToken - элемент размеченного текста: символ, экранированная
+// последовательность, тег HTML или маркер MarkdownV2
+type msgToken struct {
+	text   string
+	plain  string // видимый текст без разметки
+	marker string // имя тега или маркер форматирования, "" для текста
+	open   bool   // открывающий тег; для маркеров MarkdownV2 определяется по стеку
+	close  bool   // закрывающий тег HTML
+}
+
+// tokenize разбивает сообщение на элементы, которые нельзя разрезать
+func tokenize(text, mode string) []msgToken {
+	var tokens []msgToken
+	inCode := false
+	for i := 0; i < len(text); {
+		rest := text[i:]
+		r, size := utf8.DecodeRuneInString(rest)
+		token := msgToken{text: rest[:size], plain: rest[:size]}
 
-	for _, line := range lines {
-		if len(currentPart)+len(line)+1 > maxLength {
-			if currentPart != "" {
-				parts = append(parts, currentPart)
+		switch mode {
+		case "HTML":
+			switch r {
+			case '<':
+				if end := strings.IndexByte(rest, '>'); end > 0 {
+					tag := rest[:end+1]
+					name := strings.Trim(tag, "</>")
+					name, _, _ = strings.Cut(name, " ")
+					token = msgToken{text: tag, marker: strings.ToLower(name)}
+					token.close = strings.HasPrefix(tag, "</")
+					token.open = !token.close
+				}
+			case '&':
+				if end := strings.IndexByte(rest, ';'); end > 0 && end <= 10 {
+					token = msgToken{text: rest[:end+1], plain: html.UnescapeString(rest[:end+1])}
+				}
 			}
-			currentPart = line
+		case "MarkdownV2":
+			switch {
+			case r == '\\' && len(rest) > 1:
+				_, next := utf8.DecodeRuneInString(rest[1:])
+				token = msgToken{text: rest[:1+next], plain: rest[1 : 1+next]}
+			case strings.HasPrefix(rest, "```"):
+				token = msgToken{text: "```", marker: "```"}
+				// Открывающий fence вместе со строкой языка и переводом строки - один
+				// элемент: без перевода строки первая строка кода станет языком
+				if line, _, found := strings.Cut(rest[3:], "\n"); !inCode && found && !strings.Contains(line, "`") {
+					token = msgToken{text: rest[:3+len(line)+1], plain: "\n", marker: "```"}
+				}
+				inCode = !inCode
+			case inCode:
+			case r == '[' || strings.HasPrefix(rest, "!["):
+				// Ссылка [текст](url) и эмодзи ![👍](tg://emoji?id=...) - один элемент,
+				// иначе разбиение может разрезать URL
+				if n := markdownLink(rest); n > 0 {
+					token = msgToken{text: rest[:n], plain: markdownLinkPlain(rest[:n])}
+				}
+			case r == '`':
+				token = msgToken{text: "`", marker: "`"}
+			case strings.HasPrefix(rest, "||"), strings.HasPrefix(rest, "__"):
+				token = msgToken{text: rest[:2], marker: rest[:2]}
+			case r == '*' || r == '_' || r == '~':
+				token = msgToken{text: rest[:1], marker: rest[:1]}
+			}
+		}
+		tokens = append(tokens, token)
+		i += len(token.text)
+	}
+	return tokens
+}
+
+// markdownLink возвращает длину ссылки MarkdownV2 в начале текста или 0
+func markdownLink(text string) int {
+	i := strings.IndexByte(text, '[') + 1
+	if end := markdownClosing(text[i:], ']'); end >= 0 && strings.HasPrefix(text[i+end+1:], "(") {
+		i += end + 2
+		if end := markdownClosing(text[i:], ')'); end >= 0 {
+			return i + end + 1
+		}
+	}
+	return 0
+}
+
+// markdownClosing ищет неэкранированный символ; переводы строки внутри ссылки не допускаются
+func markdownClosing(text string, closing byte) int {
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '\n':
+			return -1
+		case closing:
+			return i
+		}
+	}
+	return -1
+}
+
+// markdownLinkPlain - видимый текст ссылки и её адрес для отправки без разметки
+func markdownLinkPlain(link string) string {
+	start := strings.IndexByte(link, '[') + 1
+	end := start + markdownClosing(link[start:], ']')
+	text := stripFormatting(link[start:end], "MarkdownV2")
+	url := link[end+2 : len(link)-1]
+	if strings.HasPrefix(link, "!") {
+		return text
+	}
+	return text + " (" + strings.NewReplacer(`\)`, ")", `\\`, `\`).Replace(url) + ")"
+}
+
+// stripFormatting убирает разметку, оставляя видимый текст
+func stripFormatting(text, mode string) string {
+	var b strings.Builder
+	for _, token := range tokenize(text, mode) {
+		b.WriteString(token.plain)
+	}
+	return b.String()
+}
+
+// formatStack - открытые теги или маркеры в точке разбиения сообщения
+type formatStack []msgToken
+
+// apply учитывает тег или маркер в стеке открытых
+func (s formatStack) apply(token msgToken) formatStack {
+	if token.marker == "" {
+		return s
+	}
+	// Маркер MarkdownV2 закрывает такой же открытый, тег HTML - тег с тем же именем
+	if !token.open {
+		if i := s.index(token.marker); i >= 0 {
+			return append(s[:i:i], s[i+1:]...)
+		}
+		if token.close {
+			return s
+		}
+	}
+	return append(s[:len(s):len(s)], token)
+}
+
+// index возвращает позицию последнего открытого тега или маркера с таким именем, -1 если его нет
+func (s formatStack) index(marker string) int {
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i].marker == marker {
+			return i
+		}
+	}
+	return -1
+}
+
+// closing возвращает разметку, закрывающую все открытые теги
+func (s formatStack) closing() string {
+	var b strings.Builder
+	for i := len(s) - 1; i >= 0; i-- {
+		if strings.HasPrefix(s[i].text, "<") {
+			b.WriteString("</" + s[i].marker + ">")
 		} else {
-			if currentPart != "" {
-				currentPart += "\n"
+			b.WriteString(s[i].marker)
+		}
+	}
+	return b.String()
+}
+
+// opening возвращает разметку, заново открывающую теги в следующей части
+func (s formatStack) opening() string {
+	var b strings.Builder
+	for _, token := range s {
+		b.WriteString(token.text)
+	}
+	return b.String()
+}
+
+// Разбивка длинного текста на части не длиннее maxLength символов. Текст
+// режется по строкам, слишком длинная строка - посимвольно, но не внутри тега,
+// HTML-сущности или экранированного символа; открытое форматирование
+// закрывается в конце части и открывается заново в следующей. Если заново
+// открытые теги (например, длинный <a href>) не оставляют места для текста,
+// остаток форматированного фрагмента отправляется без разметки
+func splitLongMessage(text string, maxLength int, mode string) []string {
+	var parts []string
+	var current strings.Builder
+	var stack formatStack
+	length := 0
+
+	// Форматирование, которое не удалось открыть заново: его закрывающие
+	// теги и маркеры пропускаются
+	var dropped formatStack
+
+	// Последний перевод строки в текущей части: позиция и открытые теги
+	lastNewline := -1
+	var newlineStack formatStack
+
+	flush := func(text string, open formatStack) {
+		if strings.TrimSpace(stripFormatting(text, mode)) != "" {
+			parts = append(parts, text+open.closing())
+		}
+	}
+
+	for _, token := range tokenize(text, mode) {
+		if token.marker != "" && !token.open && stack.index(token.marker) < 0 {
+			if i := dropped.index(token.marker); i >= 0 {
+				dropped = append(dropped[:i:i], dropped[i+1:]...)
+				continue
 			}
-			currentPart += line
 		}
+
+		// Закрывающий тег места не добавляет: он уже учтён в closing()
+		size := utf8.RuneCountInString(token.text)
+		next := stack.apply(token)
+		closing := len(next) < len(stack)
+		split := false
+		for !closing && length+size+utf8.RuneCountInString(next.closing()) > maxLength && length > 0 {
+			body := current.String()
+			if lastNewline > 0 {
+				// Режем по последней строке, остаток переносим в следующую часть
+				flush(body[:lastNewline], newlineStack)
+				rest := newlineStack.opening() + body[lastNewline+1:]
+				current.Reset()
+				current.WriteString(rest)
+				length = utf8.RuneCountInString(rest)
+				lastNewline = -1
+				continue
+			}
+
+			// Строка длиннее части - режем перед текущим элементом
+			flush(body, stack)
+			opening := stack.opening()
+			if utf8.RuneCountInString(opening)+size+utf8.RuneCountInString(next.closing()) > maxLength {
+				dropped = append(dropped, stack...)
+				stack = nil
+				next = stack.apply(token)
+				opening = ""
+			}
+			current.Reset()
+			current.WriteString(opening)
+			length = utf8.RuneCountInString(opening)
+			split = true
+			break
+		}
+		// Перевод строки на границе частей не нужен
+		if split && token.text == "\n" {
+			continue
+		}
+
+		if token.text == "\n" {
+			lastNewline = current.Len()
+			newlineStack = stack
+		}
+		current.WriteString(token.text)
+		length += size
+		stack = next
 	}
-	if currentPart != "" {
-		parts = append(parts, currentPart)
+	if current.Len() > 0 {
+		flush(current.String(), stack)
 	}
 	return parts
 }
 
-// Обработчик входящих webhook-запросов
-func grafanaWebhookHandler(chatID string) http.HandlerFunc {
+// escapeText экранирует текст для текущего режима разметки
+func escapeText(text string) string {
+	switch parseMode {
+	case "HTML":
+		return escapeHTML(text)
+	case "MarkdownV2":
+		return escapeMarkdown(text)
+	}
+	return text
+}
+
+// bold выделяет текст жирным в текущем режиме разметки; в plain текст не меняется
+func bold(text string) string {
+	switch parseMode {
+	case "HTML":
+		return "<b>" + escapeHTML(text) + "</b>"
+	case "MarkdownV2":
+		return "*" + escapeMarkdown(text) + "*"
+	}
+	return text
+}
+
+// parseGrafanaPayload определяет формат webhook (legacy или unified alerting
+// по наличию массива alerts) и разбирает его
+func parseGrafanaPayload(body []byte) (webhookPayload, error) {
+	var probe struct {
+		Alerts json.RawMessage `json:"alerts"`
+	}
+	if err := json.Unmarshal(body, &probe); err != nil {
+		return nil, err
+	}
+
+	if len(probe.Alerts) > 0 && string(probe.Alerts) != "null" {
+		payload := UnifiedPayload{source: "grafana"}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return nil, err
+		}
+		return payload, nil
+	}
+
+	var alert GrafanaAlert
+	if err := json.Unmarshal(body, &alert); err != nil {
+		return nil, err
+	}
+	return alert, nil
+}
+
+func (a GrafanaAlert) Source() string { return "grafana-legacy" }
+
+// Legacy alerting: один алерт, метками служат теги правила и его имя
+func (a GrafanaAlert) alerts() []alertLabels {
+	labels := map[string]string{"alertname": a.RuleName, "state": a.State}
+	for name, value := range a.Tags {
+		labels[name] = value
+	}
+	return []alertLabels{{Labels: labels, Annotations: map[string]string{"message": a.Message}}}
+}
+
+func (a GrafanaAlert) subset(indexes []int) webhookPayload { return a }
+
+func (p UnifiedPayload) Source() string { return p.source }
+
+func (p UnifiedPayload) alerts() []alertLabels {
+	labels := make([]alertLabels, len(p.Alerts))
+	for i, alert := range p.Alerts {
+		labels[i] = alertLabels{Labels: alert.Labels, Annotations: alert.Annotations}
+	}
+	return labels
+}
+
+func (p UnifiedPayload) subset(indexes []int) webhookPayload {
+	selected := make([]UnifiedAlert, len(indexes))
+	for i, index := range indexes {
+		selected[i] = p.Alerts[index]
+	}
+	p.Alerts = selected
+	return p
+}
+
+// Heading - заголовок сообщения: title от Grafana или общий alertname
+func (p UnifiedPayload) Heading() string {
+	if p.Title != "" {
+		return p.Title
+	}
+	return p.CommonLabels["alertname"]
+}
+
+// Firing возвращает сработавшие алерты
+func (p UnifiedPayload) Firing() []UnifiedAlert {
+	var firing []UnifiedAlert
+	for _, alert := range p.Alerts {
+		if alert.Status != "resolved" {
+			firing = append(firing, alert)
+		}
+	}
+	return firing
+}
+
+// Resolved возвращает разрешённые алерты
+func (p UnifiedPayload) Resolved() []UnifiedAlert {
+	var resolved []UnifiedAlert
+	for _, alert := range p.Alerts {
+		if alert.Status == "resolved" {
+			resolved = append(resolved, alert)
+		}
+	}
+	return resolved
+}
+
+// parseAlertmanagerPayload разбирает webhook Alertmanager (version 4); он
+// форматируется так же, как unified alerting Grafana. Ссылка на создание
+// silence строится по externalURL, так как Alertmanager не передаёт её в алерте
+func parseAlertmanagerPayload(body []byte) (webhookPayload, error) {
+	payload := UnifiedPayload{source: "alertmanager"}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	if payload.Version != "" && payload.Version != "4" {
+		log.Printf("Unexpected Alertmanager webhook version %q, group %s", payload.Version, payload.GroupKey)
+	}
+
+	if payload.ExternalURL != "" {
+		for i, alert := range payload.Alerts {
+			if alert.SilenceURL == "" {
+				payload.Alerts[i].SilenceURL = alertmanagerSilenceURL(payload.ExternalURL, alert.Labels)
+			}
+		}
+	}
+	return payload, nil
+}
+
+// alertmanagerSilenceURL возвращает ссылку на форму silence с метками алерта
+func alertmanagerSilenceURL(externalURL string, labels map[string]string) string {
+	var matchers []string
+	for name, value := range labels {
+		matchers = append(matchers, fmt.Sprintf("%s=%q", name, value))
+	}
+	sort.Strings(matchers)
+	filter := "{" + strings.Join(matchers, ",") + "}"
+	return strings.TrimSuffix(externalURL, "/") + "/#/silences/new?filter=" + url.QueryEscape(filter)
+}
+
+// ZabbixEvent - параметры webhook media type Zabbix. Значения задаются в
+// настройках media type макросами: event_id={EVENT.ID}, trigger_id={TRIGGER.ID},
+// severity={EVENT.SEVERITY}, host={HOST.NAME}, trigger_name={EVENT.NAME},
+// status={EVENT.STATUS}, event_value={EVENT.VALUE}, event_tags={EVENT.TAGS}
+// или {EVENT.TAGSJSON}, opdata={EVENT.OPDATA}, event_time={EVENT.DATE} {EVENT.TIME}
+type ZabbixEvent struct {
+	EventID     string     `json:"event_id"`
+	TriggerID   string     `json:"trigger_id"`
+	Severity    string     `json:"severity"`
+	Host        string     `json:"host"`
+	TriggerName string     `json:"trigger_name"`
+	Status      string     `json:"status"`
+	EventValue  string     `json:"event_value"`
+	EventTags   zabbixTags `json:"event_tags"`
+	OpData      string     `json:"opdata"`
+	EventTime   string     `json:"event_time"`
+}
+
+// zabbixTags принимает теги события строкой "tag:value, tag2" ({EVENT.TAGS})
+// или JSON-массивом [{"tag":..,"value":..}] ({EVENT.TAGSJSON}), в том числе
+// переданным строкой
+type zabbixTags []string
+
+func (t *zabbixTags) UnmarshalJSON(data []byte) error {
+	var raw string
+	if err := json.Unmarshal(data, &raw); err == nil {
+		raw = strings.TrimSpace(raw)
+		if !strings.HasPrefix(raw, "[") {
+			*t = nil
+			for _, tag := range strings.Split(raw, ",") {
+				if tag = strings.TrimSpace(tag); tag != "" {
+					*t = append(*t, tag)
+				}
+			}
+			return nil
+		}
+		data = []byte(raw)
+	}
+
+	var tags []struct {
+		Tag   string `json:"tag"`
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal(data, &tags); err != nil {
+		return err
+	}
+	*t = nil
+	for _, tag := range tags {
+		if tag.Value != "" {
+			*t = append(*t, tag.Tag+":"+tag.Value)
+		} else {
+			*t = append(*t, tag.Tag)
+		}
+	}
+	return nil
+}
+
+// Иконки важности Zabbix
+var zabbixSeverityIcons = map[string]string{
+	"not classified": "⚪",
+	"information":    "ℹ️",
+	"warning":        "⚠️",
+	"average":        "🟠",
+	"high":           "🔴",
+	"disaster":       "💥",
+}
+
+// Resolved - событие восстановления (status RESOLVED/OK или event_value 0)
+func (e ZabbixEvent) Resolved() bool {
+	status := strings.ToUpper(e.Status)
+	return status == "RESOLVED" || status == "OK" || e.EventValue == "0"
+}
+
+// parseZabbixPayload разбирает событие webhook media type Zabbix
+func parseZabbixPayload(body []byte) (webhookPayload, error) {
+	var event ZabbixEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// Метки события Zabbix: теги (tag:value), важность, хост и имя триггера
+func (e ZabbixEvent) alerts() []alertLabels {
+	labels := map[string]string{
+		"severity":  e.Severity,
+		"host":      e.Host,
+		"alertname": e.TriggerName,
+		"status":    e.Status,
+	}
+	for _, tag := range e.EventTags {
+		name, value, _ := strings.Cut(tag, ":")
+		labels[name] = value
+	}
+	return []alertLabels{{Labels: labels, Annotations: map[string]string{"opdata": e.OpData}}}
+}
+
+func (e ZabbixEvent) Source() string { return "zabbix" }
+
+func (e ZabbixEvent) subset(indexes []int) webhookPayload { return e }
+
+// Icon - иконка важности, для восстановления - ✅
+func (e ZabbixEvent) Icon() string {
+	if e.Resolved() {
+		return "✅"
+	}
+	if icon := zabbixSeverityIcons[strings.ToLower(e.Severity)]; icon != "" {
+		return icon
+	}
+	return "❓"
+}
+
+// DisplayStatus - статус события; для восстановления без status - RESOLVED
+func (e ZabbixEvent) DisplayStatus() string {
+	if e.Status == "" && e.Resolved() {
+		return "RESOLVED"
+	}
+	return e.Status
+}
+
+// EventURL - ссылка на страницу события; требует -zabbix-url, trigger_id и event_id
+func (e ZabbixEvent) EventURL() string {
+	if zabbixURL == "" || e.TriggerID == "" || e.EventID == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/tr_events.php?triggerid=%s&eventid=%s",
+		strings.TrimSuffix(zabbixURL, "/"), url.QueryEscape(e.TriggerID), url.QueryEscape(e.EventID))
+}
+
+// Встроенные шаблоны сообщений по источникам
+var builtinTemplates = map[string]string{
+	"grafana-legacy": `⚠️ {{bold .Title}}
+State: {{esc .State}}
+Rule: {{esc .RuleName}}
+{{if .RuleURL}}URL: {{esc .RuleURL}}
+{{end}}
+{{esc .Message}}
+{{if .EvalMatches}}
+{{bold "Metrics:"}}
+{{range .EvalMatches}}{{esc (printf "- %s: %.2f" .Metric .Value)}}
+{{end}}{{end}}`,
+
+	"grafana": unifiedTemplate,
+
+	"alertmanager": unifiedTemplate,
+
+	"zabbix": `{{.Icon}} {{bold .TriggerName}}
+{{with .DisplayStatus}}Status: {{esc .}}
+{{end}}{{with .Severity}}Severity: {{esc .}}
+{{end}}{{with .Host}}Host: {{esc .}}
+{{end}}{{with .OpData}}Data: {{esc .}}
+{{end}}{{with .EventTime}}Time: {{esc .}}
+{{end}}{{with .EventTags}}Tags: {{esc (join ", " .)}}
+{{end}}{{with .EventID}}Event ID: {{esc .}}
+{{end}}{{with .EventURL}}URL: {{esc .}}
+{{end}}`,
+}
+
+// Шаблон unified alerting и Alertmanager: сначала сработавшие алерты, затем
+// разрешённые. Все значения проходят через esc или bold, чтобы не сломать
+// разметку в режимах HTML и MarkdownV2
+const unifiedTemplate = `{{with .Heading}}{{bold .}}
+{{end}}🔥 Firing: {{len .Firing}}, ✅ Resolved: {{len .Resolved}}
+{{if .TruncatedAlerts}}{{esc (printf "(%d more alerts truncated by Grafana)" .TruncatedAlerts)}}
+{{end}}{{with .Firing}}
+{{bold "FIRING"}}
+{{range .}}{{template "alert" .}}{{end}}{{end}}{{with .Resolved}}
+{{bold "RESOLVED"}}
+{{range .}}{{template "alert" .}}{{end}}{{end}}
+
+{{- define "alert"}}
+{{if eq .Status "resolved"}}✅{{else}}🔥{{end}} {{esc .Labels.alertname}}
+{{with .Annotations.summary}}Summary: {{esc .}}
+{{end}}{{with .Annotations.description}}Description: {{esc .}}
+{{end}}{{with .ValueString}}Value: {{esc .}}
+{{end}}{{with joinLabels .Labels "alertname"}}Labels: {{esc .}}
+{{end}}{{if not .StartsAt.IsZero}}Started: {{esc (formatTime .StartsAt)}}
+{{end}}{{if and (eq .Status "resolved") (not .EndsAt.IsZero)}}Ended: {{esc (formatTime .EndsAt)}}
+{{end}}{{with .GeneratorURL}}Source: {{esc .}}
+{{end}}{{with .DashboardURL}}Dashboard: {{esc .}}
+{{end}}{{with .PanelURL}}Panel: {{esc .}}
+{{end}}{{with .SilenceURL}}Silence: {{esc .}}
+{{end}}{{end}}`
+
+// Разобранные встроенные шаблоны
+var defaultTemplates = map[string]*template.Template{}
+
+func init() {
+	for source, text := range builtinTemplates {
+		defaultTemplates[source] = template.Must(newTemplate(source).Parse(text))
+	}
+}
+
+// Функции, доступные в шаблонах
+var templateFuncs = template.FuncMap{
+	"humanize":         humanize,
+	"humanizeBytes":    humanizeBytes,
+	"humanizeDuration": humanizeDuration,
+	"formatTime":       formatTime,
+	"since":            func(t time.Time) string { return time.Since(t).Round(time.Second).String() },
+	"joinLabels":       joinLabels,
+	"join":             func(sep string, values []string) string { return strings.Join(values, sep) },
+	"truncate":         truncate,
+	"escapeMarkdown":   escapeMarkdown,
+	"escapeHTML":       escapeHTML,
+	"esc":              escapeText,
+	"bold":             bold,
+	"upper":            strings.ToUpper,
+	"lower":            strings.ToLower,
+}
+
+// newTemplate создаёт шаблон с функциями; отсутствующая метка или аннотация -
+// пустая строка, а не "<no value>"
+func newTemplate(name string) *template.Template {
+	return template.New(name).Funcs(templateFuncs).Option("missingkey=zero")
+}
+
+// loadTemplateFile читает пользовательский шаблон из файла
+func loadTemplateFile(filename string) (*template.Template, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := newTemplate(filepath.Base(filename)).Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return tmpl, nil
+}
+
+// renderMessage форматирует сообщение по шаблону; при ошибке пользовательского
+// шаблона используется встроенный
+func renderMessage(tmpl *template.Template, payload webhookPayload) string {
+	var message bytes.Buffer
+	if tmpl != nil {
+		err := tmpl.Execute(&message, payload)
+		if err == nil {
+			return message.String()
+		}
+		log.Printf("Error rendering template %s for %s: %v", tmpl.Name(), payload.Source(), err)
+		message.Reset()
+	}
+
+	if err := defaultTemplates[payload.Source()].Execute(&message, payload); err != nil {
+		log.Printf("Error rendering built-in template for %s: %v", payload.Source(), err)
+	}
+	return message.String()
+}
+
+// toFloat приводит число или строку к float64
+func toFloat(value any) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case time.Duration:
+		return v.Seconds(), true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// humanize выводит число с десятичным суффиксом: 1.5k, 2.3M
+func humanize(value any) string {
+	f, ok := toFloat(value)
+	if !ok {
+		return fmt.Sprint(value)
+	}
+	suffixes := []string{"", "k", "M", "G", "T", "P"}
+	i := 0
+	for math.Abs(f) >= 1000 && i < len(suffixes)-1 {
+		f /= 1000
+		i++
+	}
+	return fmt.Sprintf("%.4g%s", f, suffixes[i])
+}
+
+// humanizeBytes выводит размер в двоичных единицах: 1.5 KiB, 2.3 GiB
+func humanizeBytes(value any) string {
+	f, ok := toFloat(value)
+	if !ok {
+		return fmt.Sprint(value)
+	}
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+	i := 0
+	for math.Abs(f) >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.4g %s", f, units[i])
+}
+
+// humanizeDuration выводит длительность в секундах (или time.Duration) как 1h2m3s
+func humanizeDuration(value any) string {
+	f, ok := toFloat(value)
+	if !ok {
+		return fmt.Sprint(value)
+	}
+	d := time.Duration(f * float64(time.Second))
+	if d >= time.Second {
+		d = d.Round(time.Second)
+	}
+	return d.String()
+}
+
+// formatTime форматирует время; layout по умолчанию - 2006-01-02 15:04:05 MST
+func formatTime(t time.Time, layout ...string) string {
+	if len(layout) > 0 {
+		return t.Format(layout[0])
+	}
+	return t.Format("2006-01-02 15:04:05 MST")
+}
+
+// joinLabels выводит метки как name=value через запятую в алфавитном порядке,
+// пропуская перечисленные
+func joinLabels(labels map[string]string, exclude ...string) string {
+	var pairs []string
+	for name, value := range labels {
+		if !slices.Contains(exclude, name) {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", name, value))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+// truncate обрезает строку до n символов, добавляя многоточие
+func truncate(n int, text string) string {
+	runes := []rune(text)
+	if len(runes) <= n {
+		return text
+	}
+	if n < 1 {
+		return ""
+	}
+	return string(runes[:n-1]) + "…"
+}
+
+// escapeMarkdown экранирует спецсимволы Telegram MarkdownV2
+func escapeMarkdown(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		if strings.ContainsRune("_*[]()~`>#+-=|{}.!\\", r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// escapeHTML экранирует текст для Telegram HTML
+func escapeHTML(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+}
+
+// ChatTarget - чат и, для форумов, тема, куда отправляется сообщение
+type ChatTarget struct {
+	ChatID  chatID `json:"chat_id"`
+	TopicID int    `json:"topic_id"`
+}
+
+// chatID принимает идентификатор чата строкой или числом
+type chatID string
+
+func (c *chatID) UnmarshalJSON(data []byte) error {
+	var number json.Number
+	if err := json.Unmarshal(data, &number); err == nil {
+		*c = chatID(number)
+		return nil
+	}
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return err
+	}
+	*c = chatID(name)
+	return nil
+}
+
+// Route - маршрут: все заданные условия должны выполняться; значения
+// регулярных выражений проверяются целиком, как в Alertmanager
+type Route struct {
+	Name          string            `json:"name"`
+	Labels        map[string]string `json:"labels"`
+	LabelsRE      map[string]string `json:"labels_re"`
+	Annotations   map[string]string `json:"annotations"`
+	AnnotationsRE map[string]string `json:"annotations_re"`
+	Chats         []ChatTarget      `json:"chats"`
+	Continue      bool              `json:"continue"` // проверять следующие маршруты после совпадения
+	Template      string            `json:"template"` // файл шаблона сообщений этого маршрута
+
+	labelsRE      map[string]*regexp.Regexp
+	annotationsRE map[string]*regexp.Regexp
+	template      *template.Template
+}
+
+// RoutingConfig - файл маршрутизации; default используется для алертов, не
+// совпавших ни с одним маршрутом. Templates задаёт файлы шаблонов по
+// источникам (grafana, grafana-legacy, alertmanager, zabbix); шаблон маршрута
+// важнее шаблона источника
+type RoutingConfig struct {
+	Routes    []*Route          `json:"routes"`
+	Default   *Route            `json:"default"`
+	Templates map[string]string `json:"templates"`
+
+	templates map[string]*template.Template
+}
+
+// template возвращает шаблон для источника или nil для встроенного
+func (c *RoutingConfig) template(route *Route, source string) *template.Template {
+	if route != nil && route.template != nil {
+		return route.template
+	}
+	return c.templates[source]
+}
+
+// loadRoutingConfig читает файл маршрутизации; defaultChat из -chat-id
+// используется, если в файле нет маршрута по умолчанию
+func loadRoutingConfig(filename, defaultChat string) (*RoutingConfig, error) {
+	config := &RoutingConfig{}
+	if filename != "" {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, config); err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+	}
+
+	if config.Default == nil || len(config.Default.Chats) == 0 {
+		if defaultChat == "" {
+			return nil, errors.New("no default route and no -chat-id given")
+		}
+		config.Default = &Route{Name: "default", Chats: []ChatTarget{{ChatID: chatID(defaultChat)}}}
+	}
+
+	config.templates = map[string]*template.Template{}
+	for source, filename := range config.Templates {
+		if defaultTemplates[source] == nil {
+			return nil, fmt.Errorf("unknown template source %q", source)
+		}
+		tmpl, err := loadTemplateFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		config.templates[source] = tmpl
+	}
+
+	if config.Default.Template != "" {
+		tmpl, err := loadTemplateFile(config.Default.Template)
+		if err != nil {
+			return nil, err
+		}
+		config.Default.template = tmpl
+	}
+
+	for i, route := range config.Routes {
+		if route.Name == "" {
+			route.Name = fmt.Sprintf("#%d", i+1)
+		}
+		if len(route.Chats) == 0 {
+			return nil, fmt.Errorf("route %s has no chats", route.Name)
+		}
+		var err error
+		if route.Template != "" {
+			if route.template, err = loadTemplateFile(route.Template); err != nil {
+				return nil, fmt.Errorf("route %s: %w", route.Name, err)
+			}
+		}
+		if route.labelsRE, err = compileMatchers(route.LabelsRE); err != nil {
+			return nil, fmt.Errorf("route %s: %w", route.Name, err)
+		}
+		if route.annotationsRE, err = compileMatchers(route.AnnotationsRE); err != nil {
+			return nil, fmt.Errorf("route %s: %w", route.Name, err)
+		}
+	}
+	return config, nil
+}
+
+func compileMatchers(patterns map[string]string) (map[string]*regexp.Regexp, error) {
+	compiled := map[string]*regexp.Regexp{}
+	for name, pattern := range patterns {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regexp for %s: %w", name, err)
+		}
+		compiled[name] = re
+	}
+	return compiled, nil
+}
+
+// matches проверяет все условия маршрута; отсутствующая метка равна пустой строке
+func (r *Route) matches(alert alertLabels) bool {
+	for name, value := range r.Labels {
+		if alert.Labels[name] != value {
+			return false
+		}
+	}
+	for name, re := range r.labelsRE {
+		if !re.MatchString(alert.Labels[name]) {
+			return false
+		}
+	}
+	for name, value := range r.Annotations {
+		if alert.Annotations[name] != value {
+			return false
+		}
+	}
+	for name, re := range r.annotationsRE {
+		if !re.MatchString(alert.Annotations[name]) {
+			return false
+		}
+	}
+	return true
+}
+
+// delivery - алерты (номера в payload), отправляемые в один чат, и маршрут,
+// первым направивший туда алерт (его шаблон используется для сообщения)
+type delivery struct {
+	Chat    ChatTarget
+	Route   *Route
+	Indexes []int
+}
+
+// route распределяет алерты по чатам. Алерт, попавший в один чат по разным
+// маршрутам, отправляется туда один раз
+func (c *RoutingConfig) route(alerts []alertLabels) []delivery {
+	var deliveries []delivery
+	byChat := map[ChatTarget]int{}
+	add := func(route *Route, chat ChatTarget, index int) {
+		i, ok := byChat[chat]
+		if !ok {
+			i = len(deliveries)
+			byChat[chat] = i
+			deliveries = append(deliveries, delivery{Chat: chat, Route: route})
+		}
+		indexes := deliveries[i].Indexes
+		if len(indexes) == 0 || indexes[len(indexes)-1] != index {
+			deliveries[i].Indexes = append(indexes, index)
+		}
+	}
+
+	for index, alert := range alerts {
+		matched := false
+		for _, route := range c.Routes {
+			if !route.matches(alert) {
+				continue
+			}
+			matched = true
+			for _, chat := range route.Chats {
+				add(route, chat, index)
+			}
+			if !route.Continue {
+				break
+			}
+		}
+		if !matched {
+			for _, chat := range c.Default.Chats {
+				add(c.Default, chat, index)
+			}
+		}
+	}
+	return deliveries
+}
+
+// reloadRoutes перечитывает файл маршрутизации; при ошибке остаётся прежняя конфигурация
+func reloadRoutes(filename, defaultChat string) error {
+	config, err := loadRoutingConfig(filename, defaultChat)
+	if err != nil {
+		return err
+	}
+	routes.Store(config)
+	log.Printf("Routing config loaded: %d routes", len(config.Routes))
+	return nil
+}
+
+// Обработчик входящих webhook-запросов; parse разбирает тело запроса
+// конкретного источника
+func webhookHandler(parse func([]byte) (webhookPayload, error)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -93,71 +1173,409 @@ func grafanaWebhookHandler(chatID string) http.HandlerFunc {
 			return
 		}
 
-		var alert GrafanaAlert
-		if err := json.Unmarshal(body, &alert); err != nil {
+		payload, err := parse(body)
+		if err != nil {
 			http.Error(w, "Error parsing JSON", http.StatusBadRequest)
 			return
 		}
 
-		// Форматирование сообщения
-		var message bytes.Buffer
-		message.WriteString(fmt.Sprintf("⚠️ *%s*\n", alert.Title))
-		message.WriteString(fmt.Sprintf("State: %s\n", alert.State))
-		message.WriteString(fmt.Sprintf("Rule: %s\n", alert.RuleName))
-		
-		if alert.RuleURL != "" {
-			message.WriteString(fmt.Sprintf("URL: %s\n", alert.RuleURL))
+		// Сообщения для всех чатов маршрута ставятся в очередь вместе, отправка - в фоне
+		config := routes.Load()
+		var batch []outgoingMessage
+		for _, d := range config.route(payload.alerts()) {
+			message := renderMessage(config.template(d.Route, payload.Source()), payload.subset(d.Indexes))
+			batch = append(batch, outgoingMessage{Chat: d.Chat, Parts: messageParts(message)})
 		}
-		
-		message.WriteString(fmt.Sprintf("\n%s\n", alert.Message))
-		
-		if len(alert.EvalMatches) > 0 {
-			message.WriteString("\n*Metrics:*\n")
-			for _, match := range alert.EvalMatches {
-				message.WriteString(fmt.Sprintf("- %s: %.2f\n", match.Metric, match.Value))
-			}
+		if err := queue.enqueue(batch); err != nil {
+			log.Printf("Error queueing message: %v", err)
+			http.Error(w, "Error queueing message", http.StatusInternalServerError)
+			return
 		}
 
-		// Разбивка и отправка сообщений
-		parts := splitLongMessage(message.String(), maxMessageChars)
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("Queued"))
+	}
+}
+
+// messageParts разбивает сообщение на части и нумерует их
+func messageParts(message string) []string {
+	// Запас на номер части "(1/10)\n"
+	parts := splitLongMessage(message, maxMessageChars-16, parseMode)
+	if len(parts) > 1 {
 		for i, part := range parts {
-			if len(parts) > 1 {
-				part = fmt.Sprintf("(%d/%d)\n%s", i+1, len(parts), part)
+			parts[i] = escapeText(fmt.Sprintf("(%d/%d)", i+1, len(parts))) + "\n" + part
+		}
+	}
+	return parts
+}
+
+// sendPart отправляет часть сообщения. Если Telegram не разобрал разметку,
+// часть отправляется повторно простым текстом
+func sendPart(chat ChatTarget, part, mode string) error {
+	err := sendToTelegram(string(chat.ChatID), chat.TopicID, part, mode)
+	var tgErr *telegramError
+	if errors.As(err, &tgErr) && tgErr.entityError() {
+		log.Printf("Telegram rejected %s formatting, resending as plain text: %s", mode, tgErr.Description)
+		err = sendToTelegram(string(chat.ChatID), chat.TopicID, stripFormatting(part, mode), "plain")
+	}
+	return err
+}
+
+// Параметры повторных попыток отправки
+const (
+	retryBaseDelay = 5 * time.Second
+	retryMaxDelay  = 10 * time.Minute
+)
+
+// queuedMessage - сообщение в очереди; Sent - число уже доставленных частей,
+// повторная попытка продолжает со следующей части
+type queuedMessage struct {
+	ID          string     `json:"id"`
+	Chat        ChatTarget `json:"chat"`
+	ParseMode   string     `json:"parse_mode"`
+	Parts       []string   `json:"parts"`
+	Sent        int        `json:"sent"`
+	Attempts    int        `json:"attempts"`
+	NextAttempt time.Time  `json:"next_attempt"`
+	LastError   string     `json:"last_error,omitempty"`
+	Created     time.Time  `json:"created"`
+}
+
+// outboundQueue - очередь исходящих сообщений на диске: каждое сообщение -
+// отдельный файл <id>.json, который переписывается после каждой доставленной
+// части и удаляется после последней. Сообщения, отклонённые Telegram без
+// возможности повтора, переносятся в failed/
+type outboundQueue struct {
+	dir      string
+	mu       sync.Mutex
+	messages []*queuedMessage // в порядке id
+	seq      atomic.Uint64
+	wake     chan struct{}
+}
+
+// newOutboundQueue открывает очередь и загружает недоставленные сообщения
+func newOutboundQueue(dir string) (*outboundQueue, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "failed"), 0o755); err != nil {
+		return nil, err
+	}
+	q := &outboundQueue{dir: dir, wake: make(chan struct{}, 1)}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		message := &queuedMessage{}
+		if err := json.Unmarshal(data, message); err != nil {
+			log.Printf("Skipping corrupted queue file %s: %v", file, err)
+			continue
+		}
+		q.messages = append(q.messages, message)
+	}
+	return q, nil
+}
+
+// depth возвращает число недоставленных сообщений
+func (q *outboundQueue) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.messages)
+}
+
+// outgoingMessage - сообщение одному чату перед постановкой в очередь
+type outgoingMessage struct {
+	Chat  ChatTarget
+	Parts []string
+}
+
+// enqueue сохраняет сообщения одного webhook на диск и будит отправителя.
+// Отправитель видит их только после сохранения всех: если какое-то не
+// сохранилось, уже записанные файлы удаляются, и повтор webhook отправителем
+// не продублирует сообщения в остальные чаты
+func (q *outboundQueue) enqueue(batch []outgoingMessage) error {
+	now := time.Now()
+	var messages []*queuedMessage
+	for _, out := range batch {
+		message := &queuedMessage{
+			ID:          fmt.Sprintf("%020d-%06d", now.UnixNano(), q.seq.Add(1)%1000000),
+			Chat:        out.Chat,
+			ParseMode:   parseMode,
+			Parts:       out.Parts,
+			NextAttempt: now,
+			Created:     now,
+		}
+		if err := q.save(message); err != nil {
+			for _, saved := range messages {
+				if err := os.Remove(q.path(saved)); err != nil {
+					log.Printf("Error removing queue file for message %s: %v", saved.ID, err)
+				}
 			}
-			
-			if err := sendToTelegram(chatID, part); err != nil {
-				log.Printf("Error sending to Telegram: %v", err)
-				http.Error(w, "Error sending message", http.StatusInternalServerError)
-				return
+			return fmt.Errorf("chat %s: %w", out.Chat.ChatID, err)
+		}
+		messages = append(messages, message)
+	}
+
+	q.mu.Lock()
+	q.messages = append(q.messages, messages...)
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (q *outboundQueue) path(message *queuedMessage) string {
+	return filepath.Join(q.dir, message.ID+".json")
+}
+
+// save атомарно записывает состояние сообщения
+func (q *outboundQueue) save(message *queuedMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	tmp := q.path(message) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path(message))
+}
+
+// remove убирает сообщение из очереди; failed - перенести файл в failed/
+func (q *outboundQueue) remove(message *queuedMessage, failed bool) {
+	q.mu.Lock()
+	q.messages = slices.DeleteFunc(q.messages, func(m *queuedMessage) bool { return m == message })
+	q.mu.Unlock()
+
+	var err error
+	if failed {
+		err = os.Rename(q.path(message), filepath.Join(q.dir, "failed", message.ID+".json"))
+	} else {
+		err = os.Remove(q.path(message))
+	}
+	if err != nil {
+		log.Printf("Error removing queue file for message %s: %v", message.ID, err)
+	}
+}
+
+// run - фоновый отправитель: доставляет готовые сообщения и ждёт нового
+// сообщения или времени следующей попытки
+func (q *outboundQueue) run() {
+	for {
+		var timer <-chan time.Time
+		if next := q.deliverReady(); !next.IsZero() {
+			timer = time.After(time.Until(next))
+		}
+		select {
+		case <-q.wake:
+		case <-timer:
+		}
+	}
+}
+
+// deliverReady отправляет сообщения, время попытки которых наступило, и
+// возвращает время ближайшей следующей попытки. Сообщения одного чата
+// отправляются по порядку: пока предыдущее ждёт повтора, следующие не идут
+func (q *outboundQueue) deliverReady() time.Time {
+	q.mu.Lock()
+	pending := slices.Clone(q.messages)
+	q.mu.Unlock()
+
+	var next time.Time
+	blocked := map[ChatTarget]bool{}
+	for _, message := range pending {
+		if blocked[message.Chat] {
+			continue
+		}
+		if time.Now().Before(message.NextAttempt) || !q.deliver(message) {
+			blocked[message.Chat] = true
+			if next.IsZero() || message.NextAttempt.Before(next) {
+				next = message.NextAttempt
 			}
 		}
+	}
+	return next
+}
+
+// deliver отправляет оставшиеся части сообщения; false - нужна повторная попытка
+func (q *outboundQueue) deliver(message *queuedMessage) bool {
+	for message.Sent < len(message.Parts) {
+		err := sendPart(message.Chat, message.Parts[message.Sent], message.ParseMode)
+		if err != nil {
+			return q.retry(message, err)
+		}
+
+		// Состояние сохраняется после каждой части, чтобы повтор её не дублировал
+		message.Sent++
+		if message.Sent < len(message.Parts) {
+			if err := q.save(message); err != nil {
+				log.Printf("Error saving queue state for message %s: %v", message.ID, err)
+			}
+		}
+	}
+	q.remove(message, false)
+	return true
+}
+
+// retry планирует повторную попытку с экспоненциальной задержкой или, для
+// 429, через retry_after. Ошибки 4xx, кроме 429, не исправятся повтором -
+// такое сообщение переносится в failed/
+func (q *outboundQueue) retry(message *queuedMessage, err error) bool {
+	message.Attempts++
+	message.LastError = err.Error()
+
+	var tgErr *telegramError
+	if errors.As(err, &tgErr) && tgErr.StatusCode >= 400 && tgErr.StatusCode < 500 &&
+		tgErr.StatusCode != http.StatusTooManyRequests {
+		log.Printf("Telegram rejected message %s for chat %s, moving to failed: %v", message.ID, message.Chat.ChatID, err)
+		if err := q.save(message); err != nil {
+			log.Printf("Error saving queue state for message %s: %v", message.ID, err)
+		}
+		q.remove(message, true)
+		return true
+	}
+
+	delay := retryMaxDelay
+	if message.Attempts < 20 {
+		delay = min(retryBaseDelay<<(message.Attempts-1), retryMaxDelay)
+	}
+	if tgErr != nil && tgErr.RetryAfter > 0 {
+		delay = tgErr.RetryAfter
+	}
+	message.NextAttempt = time.Now().Add(delay)
+	log.Printf("Error sending message %s to chat %s (part %d/%d, attempt %d), retrying in %s: %v",
+		message.ID, message.Chat.ChatID, message.Sent+1, len(message.Parts), message.Attempts, delay, err)
+
+	if err := q.save(message); err != nil {
+		log.Printf("Error saving queue state for message %s: %v", message.ID, err)
+	}
+	return false
+}
+
+// runRender - подкоманда render: форматирует пример webhook шаблоном и
+// печатает сообщение, ничего не отправляя
+func runRender(args []string) {
+	flags := flag.NewFlagSet("render", flag.ExitOnError)
+	source := flags.String("source", "grafana", "Payload source: grafana (legacy or unified), alertmanager or zabbix")
+	templateFile := flags.String("template", "", "Template file (default: built-in template)")
+	flags.StringVar(&zabbixURL, "zabbix-url", "", "Zabbix frontend URL for event links")
+	flags.StringVar(&parseMode, "parse-mode", "plain", "Telegram formatting: plain, HTML or MarkdownV2")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s render [flags] payload.json\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if parseMode = parseModes[strings.ToLower(parseMode)]; parseMode == "" {
+		log.Fatal("parse-mode must be plain, HTML or MarkdownV2")
+	}
 
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("Processed"))
+	parsers := map[string]func([]byte) (webhookPayload, error){
+		"grafana":      parseGrafanaPayload,
+		"alertmanager": parseAlertmanagerPayload,
+		"zabbix":       parseZabbixPayload,
+	}
+	parse := parsers[*source]
+	if parse == nil {
+		log.Fatalf("Unknown source %q", *source)
+	}
+
+	body, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		log.Fatalf("Failed to read payload: %v", err)
+	}
+	payload, err := parse(body)
+	if err != nil {
+		log.Fatalf("Failed to parse payload: %v", err)
+	}
+
+	tmpl := defaultTemplates[payload.Source()]
+	if *templateFile != "" {
+		if tmpl, err = loadTemplateFile(*templateFile); err != nil {
+			log.Fatalf("Failed to load template: %v", err)
+		}
+	}
+	if err := tmpl.Execute(os.Stdout, payload); err != nil {
+		log.Fatalf("Failed to render template: %v", err)
 	}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "render" {
+		runRender(os.Args[2:])
+		return
+	}
+
 	// Обработка параметров командной строки
-	var chatID string
-	flag.StringVar(&chatID, "chat-id", "", "Telegram Chat ID (required)")
+	var defaultChat, routesFile string
+	flag.StringVar(&defaultChat, "chat-id", "", "Telegram Chat ID for alerts not matched by any route (required without -routes)")
+	flag.StringVar(&routesFile, "routes", "", "JSON routing config: label/annotation matchers to chats and topics; reloaded on SIGHUP or POST /-/reload")
 	flag.StringVar(&listenPort, "port", "8080", "Port to listen on")
+	flag.StringVar(&zabbixURL, "zabbix-url", "", "Zabbix frontend URL for event links, e.g. https://zabbix.example.com")
+	flag.StringVar(&parseMode, "parse-mode", "plain", "Telegram formatting: plain, HTML or MarkdownV2")
+	queueDir := flag.String("queue-dir", "queue", "Directory of the persistent outbound message queue")
 	flag.Parse()
 
+	if parseMode = parseModes[strings.ToLower(parseMode)]; parseMode == "" {
+		log.Fatal("parse-mode must be plain, HTML or MarkdownV2")
+	}
+
 	// Проверка обязательных параметров
 	if telegramToken == "" {
 		log.Fatal("TELEGRAM_TOKEN environment variable must be set")
 	}
-	if chatID == "" {
-		log.Fatal("chat-id parameter is required")
+	if err := reloadRoutes(routesFile, defaultChat); err != nil {
+		log.Fatalf("Failed to load routing config: %v", err)
 	}
 
+	// Перечитывание маршрутов по SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reloadRoutes(routesFile, defaultChat); err != nil {
+				log.Printf("Failed to reload routing config: %v", err)
+			}
+		}
+	}()
+
 	// Формирование URL вебхука Telegram
 	targetWebhook = fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", telegramToken)
 
+	// Очередь исходящих сообщений: недоставленные до перезапуска отправляются снова
+	var err error
+	if queue, err = newOutboundQueue(*queueDir); err != nil {
+		log.Fatalf("Failed to open queue: %v", err)
+	}
+	log.Printf("Outbound queue %s: %d messages pending", *queueDir, queue.depth())
+	go queue.run()
+
 	// Настройка HTTP сервера
-	http.HandleFunc("/webhook", grafanaWebhookHandler(chatID))
+	http.HandleFunc("/webhook", webhookHandler(parseGrafanaPayload))
+	http.HandleFunc("/alertmanager", webhookHandler(parseAlertmanagerPayload))
+	http.HandleFunc("/zabbix", webhookHandler(parseZabbixPayload))
+	http.HandleFunc("/-/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := reloadRoutes(routesFile, defaultChat); err != nil {
+			log.Printf("Failed to reload routing config: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("Reloaded"))
+	})
 	log.Printf("Server listening on port %s", listenPort)
-	log.Printf("Forwarding alerts to chat ID: %s", chatID)
 	log.Fatal(http.ListenAndServe(":"+listenPort, nil))
-}
\ No newline at end of file
+}
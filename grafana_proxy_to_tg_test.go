@@ -0,0 +1,86 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitLongMessage(t *testing.T) {
+	tests := []struct {
+		name, text, mode string
+		max              int
+		want             []string
+	}{
+		{"plain by lines", "first line\nsecond line\nthird", "plain", 12,
+			[]string{"first line", "second line", "third"}},
+		{"plain long line", "abcdefghij", "plain", 4,
+			[]string{"abcd", "efgh", "ij"}},
+		{"html reopened tag", "<b>bold text here</b>", "HTML", 12,
+			[]string{"<b>bold </b>", "<b>text </b>", "<b>here</b>"}},
+		{"html entity", "aaa&amp;bbb", "HTML", 5,
+			[]string{"aaa", "&amp;", "bbb"}},
+		{"html link longer than limit", `<a href="https://example.com/x">link text</a> tail`, "HTML", 20,
+			[]string{"link text tail"}},
+		{"markdown reopened marker", "*bold text here*", "MarkdownV2", 7,
+			[]string{"*bold *", "*text *", "*here*"}},
+		{"markdown escape", `aaa\.bbb`, "MarkdownV2", 4,
+			[]string{"aaa", `\.bb`, "b"}},
+		{"markdown link", "aaaaaaaaaa [llllllll](http://example.com/pppppppppp) tail", "MarkdownV2", 25,
+			[]string{"aaaaaaaaaa ", "[llllllll](http://example.com/pppppppppp)", " tail"}},
+		{"code fence by lines", "intro\n```\nline one\nline two\n```\nend", "MarkdownV2", 20,
+			[]string{"intro", "```\nline one```", "```\nline two\n```\nend"}},
+		{"code fence language", "```go\nfmt.Println(1)\n```", "MarkdownV2", 15,
+			[]string{"```go\nfmt.Pr```", "```go\nintln(```", "```go\n1)\n```"}},
+	}
+	for _, tt := range tests {
+		got := splitLongMessage(tt.text, tt.max, tt.mode)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: splitLongMessage(%q, %d) = %q, want %q", tt.name, tt.text, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestSplitLongMessageLimit(t *testing.T) {
+	tests := []struct {
+		text, mode string
+	}{
+		{strings.Repeat("<b>bold</b> <i>italic <u>under</u></i>\n", 20), "HTML"},
+		{strings.Repeat(`<a href="https://example.com/">link</a> &lt;text&gt;`+"\n", 20), "HTML"},
+		{strings.Repeat("*bold* _italic_ ||spoiler|| `code` [ln](e.co/a\\)b)\n", 20), "MarkdownV2"},
+		{"```sql\n" + strings.Repeat("SELECT 1;\n", 30) + "```", "MarkdownV2"},
+	}
+	for _, tt := range tests {
+		for _, max := range []int{20, 50, 100} {
+			parts := splitLongMessage(tt.text, max, tt.mode)
+			var visible strings.Builder
+			for _, part := range parts {
+				if n := utf8.RuneCountInString(part); n > max {
+					t.Errorf("%s part %q: %d runes, limit %d", tt.mode, part, n, max)
+				}
+				visible.WriteString(stripFormatting(part, tt.mode))
+			}
+			// Переводы строк на границах частей отбрасываются, остальной текст сохраняется
+			want := strings.ReplaceAll(stripFormatting(tt.text, tt.mode), "\n", "")
+			if got := strings.ReplaceAll(visible.String(), "\n", ""); got != want {
+				t.Errorf("%s limit %d: visible text %q, want %q", tt.mode, max, got, want)
+			}
+		}
+	}
+}
+
+func TestStripFormatting(t *testing.T) {
+	tests := []struct {
+		text, mode, want string
+	}{
+		{`<b>a &amp; b</b> <a href="http://x/">link</a>`, "HTML", "a & b link"},
+		{`*a\.b* [link \[1\]](http://x/\)y) ![👍](tg://emoji?id=1)`, "MarkdownV2", "a.b link [1] (http://x/)y) 👍"},
+		{"```go\ncode\n```", "MarkdownV2", "\ncode\n"},
+	}
+	for _, tt := range tests {
+		if got := stripFormatting(tt.text, tt.mode); got != tt.want {
+			t.Errorf("stripFormatting(%q, %s) = %q, want %q", tt.text, tt.mode, got, tt.want)
+		}
+	}
+}
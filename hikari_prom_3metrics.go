@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"sort"
 	"strconv"
 	"strings"
@@ -30,9 +34,73 @@ type MetricResult struct {
 	SortKey string
 }
 
+// inventoryDatasource - JDBC-ресурс из инвентаризации download_context.go (-mode inventory -format json)
+type inventoryDatasource struct {
+	File     string `json:"file"`
+	Name     string `json:"name"`
+	MaxTotal string `json:"maxTotal"`
+}
+
+// poolMetrics - метрики одного пула Hikari: connections_max, пик за 7 дней и пик активных за 7 дней
+type poolMetrics struct {
+	AppName  string
+	Instance string
+	NodeName string
+	Pool     string
+	Values   [3]float64
+}
+
+// crossCheckRow - строка отчёта сверки настроек context.xml с метриками
+type crossCheckRow struct {
+	Server     string
+	App        string
+	Resource   string
+	Configured string
+	Metrics    *poolMetrics
+	Status     string
+}
+
 func main() {
-	prometheusURL := "http://localhost:9090/api/v1/query"
+	prometheusURL := flag.String("prometheus", "http://localhost:9090/api/v1/query", "Prometheus query API URL")
+	inventoryFile := flag.String("inventory", "", "JSON inventory from download_context.go -mode inventory -format json; enables the context.xml cross-check report")
+	appMapFile := flag.String("app-map", "", "File with appName=application-directory lines mapping Prometheus appName to /opt/solar application names")
+	nearLimit := flag.Float64("near", 0.9, "Flag pools whose 7-day active connection peak reaches this fraction of the configured limit")
+	flag.Parse()
+
+	results := collectPoolMetrics(*prometheusURL)
+
+	if *inventoryFile != "" {
+		if err := runCrossCheck(results, *inventoryFile, *appMapFile, *nearLimit); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Подготавливаем данные для вывода
+	var output []string
+	for key, values := range results {
+		// Выводим строку, если есть хотя бы одно ненулевое значение
+		if values[0] != 0 || values[1] != 0 || values[2] != 0 {
+			parts := strings.Split(key, "|")
+			if len(parts) == 5 { // Проверяем, что все метки присутствуют
+				output = append(output, fmt.Sprintf("%s|%.0f|%.0f|%.0f",
+					key, values[0], values[1], values[2]))
+			}
+		}
+	}
+
+	// Сортируем вывод для удобства
+	sort.Strings(output)
+
+	// Выводим результаты
+	fmt.Println("appName|instance|job|nodeName|pool|connections_max|max_over_time_7d|max_active_over_time_7d")
+	for _, line := range output {
+		fmt.Println(line)
+	}
+}
 
+// collectPoolMetrics выполняет три запроса и объединяет их по набору меток пула
+func collectPoolMetrics(prometheusURL string) map[string][3]float64 {
 	// Выполняем три запроса
 	maxConnections := queryPrometheus(prometheusURL, "hikaricp_connections_max")
 	maxOverTime := queryPrometheus(prometheusURL, "max_over_time(hikaricp_connections{}[7d])")
@@ -71,27 +139,207 @@ func main() {
 		}
 	}
 
-	// Подготавливаем данные для вывода
-	var output []string
+	return results
+}
+
+// runCrossCheck сопоставляет пулы из context.xml с метриками Hikari и печатает расхождения:
+// MAX_MISMATCH - настроенный максимум отличается от hikaricp_connections_max,
+// NEAR_LIMIT - пик активных соединений за 7 дней близок к лимиту, NO_METRICS / NO_CONFIG - пара не найдена
+func runCrossCheck(results map[string][3]float64, inventoryFile, appMapFile string, nearLimit float64) error {
+	data, err := os.ReadFile(inventoryFile)
+	if err != nil {
+		return fmt.Errorf("failed to read inventory: %w", err)
+	}
+	var inventory map[string]map[string][]inventoryDatasource
+	if err := json.Unmarshal(data, &inventory); err != nil {
+		return fmt.Errorf("failed to parse inventory: %w", err)
+	}
+
+	appMap := map[string]string{}
+	if appMapFile != "" {
+		if appMap, err = readAppMap(appMapFile); err != nil {
+			return fmt.Errorf("failed to read app map: %w", err)
+		}
+	}
+
+	// Группируем метрики по серверу и приложению из инвентаризации
+	pools := map[string][]*poolMetrics{}
+	var unmatched []*poolMetrics
 	for key, values := range results {
-		// Выводим строку, если есть хотя бы одно ненулевое значение
-		if values[0] != 0 || values[1] != 0 || values[2] != 0 {
-			parts := strings.Split(key, "|")
-			if len(parts) == 5 { // Проверяем, что все метки присутствуют
-				output = append(output, fmt.Sprintf("%s|%.0f|%.0f|%.0f",
-					key, values[0], values[1], values[2]))
+		parts := strings.Split(key, "|")
+		if len(parts) != 5 {
+			continue
+		}
+		pm := &poolMetrics{AppName: parts[0], Instance: parts[1], NodeName: parts[3], Pool: parts[4], Values: values}
+
+		app := pm.AppName
+		if mapped, ok := appMap[app]; ok {
+			app = mapped
+		}
+		server, app := findInventoryApp(inventory, pm, app)
+		if server == "" {
+			unmatched = append(unmatched, pm)
+			continue
+		}
+		pools[server+"|"+app] = append(pools[server+"|"+app], pm)
+	}
+
+	var rows []crossCheckRow
+	for server, apps := range inventory {
+		for app, datasources := range apps {
+			rows = append(rows, matchPools(server, app, datasources, pools[server+"|"+app], nearLimit)...)
+		}
+	}
+	for _, pm := range unmatched {
+		rows = append(rows, crossCheckRow{Metrics: pm, Status: "NO_CONFIG"})
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Server != rows[j].Server {
+			return rows[i].Server < rows[j].Server
+		}
+		if rows[i].App != rows[j].App {
+			return rows[i].App < rows[j].App
+		}
+		return rows[i].Resource+poolName(rows[i].Metrics) < rows[j].Resource+poolName(rows[j].Metrics)
+	})
+
+	fmt.Println("server|app|resource|configured_max|appName|instance|pool|connections_max|max_over_time_7d|max_active_over_time_7d|status")
+	for _, row := range rows {
+		metrics := "|||||"
+		if pm := row.Metrics; pm != nil {
+			metrics = fmt.Sprintf("%s|%s|%s|%.0f|%.0f|%.0f",
+				pm.AppName, pm.Instance, pm.Pool, pm.Values[0], pm.Values[1], pm.Values[2])
+		}
+		fmt.Printf("%s|%s|%s|%s|%s|%s\n", row.Server, row.App, row.Resource, row.Configured, metrics, row.Status)
+	}
+	return nil
+}
+
+// matchPools сопоставляет ресурсы приложения с его пулами: единственный ресурс - с единственным
+// пулом, иначе по имени (jdbc/mainDS ~ пул mainDS)
+func matchPools(server, app string, datasources []inventoryDatasource, pools []*poolMetrics, nearLimit float64) []crossCheckRow {
+	var rows []crossCheckRow
+	used := map[*poolMetrics]bool{}
+
+	for _, ds := range datasources {
+		row := crossCheckRow{Server: server, App: app, Resource: ds.Name, Configured: ds.MaxTotal}
+		if len(datasources) == 1 && len(pools) == 1 {
+			row.Metrics = pools[0]
+		} else {
+			name := strings.ToLower(strings.TrimPrefix(ds.Name, "jdbc/"))
+			for _, pm := range pools {
+				if !used[pm] && name != "" && strings.ToLower(strings.TrimPrefix(pm.Pool, "jdbc/")) == name {
+					row.Metrics = pm
+					break
+				}
 			}
 		}
+
+		if row.Metrics == nil {
+			row.Status = "NO_METRICS"
+		} else {
+			used[row.Metrics] = true
+			row.Status = poolStatus(ds.MaxTotal, row.Metrics, nearLimit)
+		}
+		rows = append(rows, row)
 	}
 
-	// Сортируем вывод для удобства
-	sort.Strings(output)
+	for _, pm := range pools {
+		if !used[pm] {
+			rows = append(rows, crossCheckRow{Server: server, App: app, Metrics: pm, Status: "NO_CONFIG"})
+		}
+	}
+	return rows
+}
 
-	// Выводим результаты
-	fmt.Println("appName|instance|job|nodeName|pool|connections_max|max_over_time_7d|max_active_over_time_7d")
-	for _, line := range output {
-		fmt.Println(line)
+// poolStatus сравнивает настроенный максимум с экспортируемым и с пиком активных соединений за 7 дней
+func poolStatus(configured string, pm *poolMetrics, nearLimit float64) string {
+	var flags []string
+
+	limit := pm.Values[0]
+	if configuredMax, err := strconv.ParseFloat(configured, 64); err == nil {
+		// нет серии hikaricp_connections_max - сравнивать не с чем
+		if pm.Values[0] > 0 && configuredMax != pm.Values[0] {
+			flags = append(flags, "MAX_MISMATCH")
+		}
+		limit = configuredMax
+	} else {
+		flags = append(flags, "UNKNOWN_CONFIGURED_MAX")
+	}
+
+	// hikaricp_connections включает простаивающие соединения, поэтому близость
+	// к лимиту оценивается только по активным
+	if limit > 0 && pm.Values[2] >= nearLimit*limit {
+		flags = append(flags, "NEAR_LIMIT")
+	}
+
+	if len(flags) == 0 {
+		return "OK"
+	}
+	return strings.Join(flags, ",")
+}
+
+// findInventoryApp ищет в инвентаризации сервер, совпадающий с instance или nodeName
+// метрики (без порта и домена), и приложение с заданным именем
+func findInventoryApp(inventory map[string]map[string][]inventoryDatasource, pm *poolMetrics, app string) (string, string) {
+	for server, apps := range inventory {
+		if !sameHost(server, pm.Instance) && !sameHost(server, pm.NodeName) {
+			continue
+		}
+		for name := range apps {
+			if strings.EqualFold(name, app) {
+				return server, name
+			}
+		}
+	}
+	return "", ""
+}
+
+// sameHost сравнивает имена хостов без учёта порта, регистра и домена
+func sameHost(a, b string) bool {
+	normalize := func(host string) string {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(host)
+		if net.ParseIP(host) == nil {
+			host, _, _ = strings.Cut(host, ".")
+		}
+		return host
+	}
+	return a != "" && b != "" && normalize(a) == normalize(b)
+}
+
+// readAppMap читает соответствие appName -> каталог приложения (строки вида appName=app)
+func readAppMap(filename string) (map[string]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	appMap := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		appName, app, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid line %q, expected appName=app", line)
+		}
+		appMap[strings.TrimSpace(appName)] = strings.TrimSpace(app)
+	}
+	return appMap, scanner.Err()
+}
+
+func poolName(pm *poolMetrics) string {
+	if pm == nil {
+		return ""
 	}
+	return pm.Pool
 }
 
 // queryPrometheus выполняет запрос к Prometheus и возвращает результаты